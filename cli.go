@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// runAdminCommand runs a CLI subcommand against the admin API of a running server:
+//
+//	chirpy backup          take a backup now
+//	chirpy backups         list backups
+//	chirpy restore <name>  restore a backup by name
+func runAdminCommand(args []string, addr, adminKey string) error {
+	var method, path string
+	switch args[0] {
+	case "backup":
+		method, path = "POST", "/admin/backups"
+	case "backups":
+		method, path = "GET", "/admin/backups"
+	case "restore":
+		if len(args) < 2 {
+			return errors.New("usage: chirpy restore <backup name>")
+		}
+		method, path = "POST", "/admin/backups/"+args[1]+"/restore"
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+
+	req, err := http.NewRequest(method, addr+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "ApiKey "+adminKey)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: %s %s", method, path, resp.Status, body)
+	}
+	_, err = io.Copy(os.Stdout, resp.Body)
+	fmt.Println()
+	return err
+}
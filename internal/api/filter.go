@@ -0,0 +1,340 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// MaxChirpLength is the longest chirp body accepted, counted in characters
+const MaxChirpLength = 140
+
+// FilterAction is what a rule does to a chirp it matches
+type FilterAction string
+
+const (
+	// FilterMask replaces the matched words with ****
+	FilterMask FilterAction = "mask"
+	// FilterReject refuses the chirp
+	FilterReject FilterAction = "reject"
+	// FilterFlag lets the chirp through unchanged but marks it for review
+	FilterFlag FilterAction = "flag"
+)
+
+// FilterRule is one rule of a content filter file.
+//
+// Words are matched as whole words, a word with spaces matches that phrase.
+// Matching ignores case, accents and the punctuation around words, so
+// "Kerfuffle!" and "KERFÜFFLE" both match "kerfuffle". WordsFile names a
+// file with one more word per line, relative to the filter file; blank lines
+// and lines starting with # are skipped. Pattern is a regular expression run
+// over the same normalized text: lowercase words without accents, separated
+// by single spaces. With Leet set, digits and @ $ are read as the letters they
+// stand in for, so "k3rfuffl3" matches too.
+type FilterRule struct {
+	Name      string       `json:"name,omitempty"`
+	Words     []string     `json:"words,omitempty"`
+	WordsFile string       `json:"words_file,omitempty"`
+	Pattern   string       `json:"pattern,omitempty"`
+	Leet      bool         `json:"leet,omitempty"`
+	Action    FilterAction `json:"action"`
+}
+
+// FilterResult is the outcome of ContentFilter.Check
+type FilterResult struct {
+	// Text is the checked text with every masked word replaced by ****
+	Text     string
+	Rejected bool
+	Flagged  bool
+	// Matched names the rules that matched, or their index if they have no name
+	Matched []string
+}
+
+// ContentFilter checks chirp bodies against a set of rules.
+// It is safe for concurrent use, Reload swaps the rules without blocking Check.
+type ContentFilter struct {
+	// path is the file the rules came from, empty for built-in rules
+	path  string
+	rules atomic.Pointer[[]compiledRule]
+}
+
+type compiledRule struct {
+	name    string
+	phrases [][]string
+	pattern *regexp.Regexp
+	leet    bool
+	action  FilterAction
+}
+
+// DefaultFilterRules are used when no filter file is configured
+var DefaultFilterRules = []FilterRule{
+	{Name: "default", Words: []string{"kerfuffle", "sharbert", "fornax"}, Action: FilterMask},
+}
+
+// NewContentFilter builds a filter from rules
+func NewContentFilter(rules []FilterRule) (*ContentFilter, error) {
+	compiled, err := compileRules(rules, "")
+	if err != nil {
+		return nil, err
+	}
+	f := &ContentFilter{}
+	f.rules.Store(&compiled)
+	return f, nil
+}
+
+// LoadContentFilter reads a JSON filter file of the form {"rules": [FilterRule, ...]}
+func LoadContentFilter(path string) (*ContentFilter, error) {
+	f := &ContentFilter{path: path}
+	err := f.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload re-reads the filter file, the old rules stay in place if it fails
+func (f *ContentFilter) Reload() error {
+	if f.path == "" {
+		return errors.New("content filter was not loaded from a file")
+	}
+	dat, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	var file struct {
+		Rules []FilterRule `json:"rules"`
+	}
+	err = json.Unmarshal(dat, &file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", f.path, err)
+	}
+	compiled, err := compileRules(file.Rules, filepath.Dir(f.path))
+	if err != nil {
+		return fmt.Errorf("%s: %w", f.path, err)
+	}
+	f.rules.Store(&compiled)
+	return nil
+}
+
+func compileRules(rules []FilterRule, dir string) ([]compiledRule, error) {
+	var result []compiledRule
+	for i, rule := range rules {
+		c := compiledRule{name: rule.Name, leet: rule.Leet, action: rule.Action}
+		if c.name == "" {
+			c.name = fmt.Sprint(i)
+		}
+		switch c.action {
+		case FilterMask, FilterReject, FilterFlag:
+		default:
+			return nil, fmt.Errorf("rule %s: action must be mask, reject or flag", c.name)
+		}
+
+		words := rule.Words
+		if rule.WordsFile != "" {
+			more, err := readWordsFile(filepath.Join(dir, rule.WordsFile))
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: %w", c.name, err)
+			}
+			words = append(append([]string(nil), words...), more...)
+		}
+		for _, word := range words {
+			var phrase []string
+			for _, t := range tokenize(word, rule.Leet) {
+				phrase = append(phrase, t.word)
+			}
+			if len(phrase) > 0 {
+				c.phrases = append(c.phrases, phrase)
+			}
+		}
+
+		if rule.Pattern != "" {
+			var err error
+			c.pattern, err = regexp.Compile("(?i)" + rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: %w", c.name, err)
+			}
+		}
+		if len(c.phrases) == 0 && c.pattern == nil {
+			return nil, fmt.Errorf("rule %s: needs words or a pattern", c.name)
+		}
+		result = append(result, c)
+	}
+	return result, nil
+}
+
+func readWordsFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var result []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		result = append(result, line)
+	}
+	return result, scanner.Err()
+}
+
+// Check runs text through every rule
+func (f *ContentFilter) Check(text string) FilterResult {
+	result := FilterResult{Text: text}
+	plain, leet := tokenize(text, false), tokenize(text, true)
+	var masked []token
+	for _, rule := range *f.rules.Load() {
+		tokens := plain
+		if rule.leet {
+			tokens = leet
+		}
+		hits := rule.match(tokens)
+		if len(hits) == 0 {
+			continue
+		}
+		result.Matched = append(result.Matched, rule.name)
+		switch rule.action {
+		case FilterMask:
+			masked = append(masked, hits...)
+		case FilterReject:
+			result.Rejected = true
+		case FilterFlag:
+			result.Flagged = true
+		}
+	}
+	result.Text = mask(text, masked)
+	return result
+}
+
+// match returns the tokens the rule matched
+func (rule compiledRule) match(tokens []token) []token {
+	var result []token
+	for _, phrase := range rule.phrases {
+		for i := 0; i+len(phrase) <= len(tokens); i++ {
+			hit := true
+			for j, word := range phrase {
+				if tokens[i+j].word != word {
+					hit = false
+					break
+				}
+			}
+			if hit {
+				result = append(result, tokens[i:i+len(phrase)]...)
+			}
+		}
+	}
+
+	if rule.pattern != nil {
+		// join the words and remember where each one starts
+		var joined strings.Builder
+		starts := make([]int, len(tokens))
+		for i, t := range tokens {
+			if i > 0 {
+				joined.WriteByte(' ')
+			}
+			starts[i] = joined.Len()
+			joined.WriteString(t.word)
+		}
+		for _, loc := range rule.pattern.FindAllStringIndex(joined.String(), -1) {
+			for i, t := range tokens {
+				if starts[i] < loc[1] && starts[i]+len(t.word) > loc[0] {
+					result = append(result, t)
+				}
+			}
+		}
+	}
+	return result
+}
+
+// token is a word of the checked text, start and end are byte offsets
+// into the original and word is its normalized form
+type token struct {
+	start, end int
+	word       string
+}
+
+// leetLetters maps the characters commonly swapped for letters back to them
+var leetLetters = map[rune]rune{
+	'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '8': 'b', '9': 'g', '@': 'a', '$': 's',
+}
+
+// tokenize splits text into words, anything but letters, digits and combining marks
+// separates them. In leet mode @ and $ count as letters and every word is read as leet.
+func tokenize(text string, leet bool) []token {
+	var result []token
+	start := -1
+	isWord := func(r rune) bool {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r) {
+			return true
+		}
+		return leet && (r == '@' || r == '$')
+	}
+	flush := func(end int) {
+		if start >= 0 {
+			result = append(result, token{start: start, end: end, word: normalizeWord(text[start:end], leet)})
+			start = -1
+		}
+	}
+	for i, r := range text {
+		if isWord(r) {
+			if start < 0 {
+				start = i
+			}
+		} else {
+			flush(i)
+		}
+	}
+	flush(len(text))
+	return result
+}
+
+// normalizeWord lowercases word and strips its accents
+func normalizeWord(word string, leet bool) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(word) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		if l, ok := leetLetters[r]; ok && leet {
+			r = l
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// mask replaces each token in text with ****, tokens may repeat and come in any order
+func mask(text string, tokens []token) string {
+	if len(tokens) == 0 {
+		return text
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].start < tokens[j].start })
+	var b strings.Builder
+	last := 0
+	for _, t := range tokens {
+		if t.end <= last {
+			continue
+		}
+		start := max(t.start, last)
+		b.WriteString(text[last:start])
+		if start == t.start {
+			b.WriteString("****")
+		}
+		last = t.end
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
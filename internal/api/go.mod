@@ -1,3 +1,5 @@
 module internal/api
 
 go 1.22.5
+
+require golang.org/x/text v0.16.0
@@ -4,7 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
-	"strings"
+	"unicode/utf8"
 )
 
 // Accept POST /api/validate_chirp
@@ -30,25 +30,35 @@ func ValidateChirp(w http.ResponseWriter, r *http.Request) {
 		SendJson(w, r, JsonErr{ErrorMsg: "Something went wrong"}, 400)
 		return
 	}
-	if len(request.Body) > 140 {
+	if utf8.RuneCountInString(request.Body) > MaxChirpLength {
 		SendJson(w, r, JsonErr{ErrorMsg: "Chirp is too long"}, 400)
 		return
 	}
-	SendJson(w, r, JsonValid{ValidMsg: CleanMsg(request.Body)}, 200)
+	result := defaultFilter.Check(request.Body)
+	if result.Rejected {
+		SendJson(w, r, JsonErr{ErrorMsg: "Chirp contains blocked content"}, 400)
+		return
+	}
+	SendJson(w, r, JsonValid{ValidMsg: result.Text}, 200)
 }
 
-func CleanMsg(inputMsg string) string {
-	badWords := []string{"kerfuffle", "sharbert", "fornax"}
-	tokens := strings.Split(inputMsg, " ")
-	for i, token := range tokens {
-		for _, badWord := range badWords {
-			if strings.ToLower(token) == badWord {
-				tokens[i] = "****"
-				break
-			}
-		}
+// defaultFilter is built from DefaultFilterRules
+var defaultFilter = DefaultContentFilter()
+
+// DefaultContentFilter returns a filter with DefaultFilterRules
+func DefaultContentFilter() *ContentFilter {
+	f, err := NewContentFilter(DefaultFilterRules)
+	if err != nil {
+		panic(err)
 	}
-	return strings.Join(tokens[:], " ")
+	return f
+}
+
+// CleanMsg masks the default bad words in inputMsg
+//
+// Deprecated: use a ContentFilter, which can also reject and flag chirps
+func CleanMsg(inputMsg string) string {
+	return defaultFilter.Check(inputMsg).Text
 }
 
 func RecieveJson(w http.ResponseWriter, r *http.Request, s interface{}) error {
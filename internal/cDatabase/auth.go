@@ -1,6 +1,8 @@
 package cDatabase
 
 import (
+	"crypto/subtle"
+	"errors"
 	"log"
 	"net/http"
 	"strings"
@@ -8,10 +10,16 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
+var errNoToken = errors.New("missing bearer token")
+
+// DecodeJWTToken parses and verifies the "Authorization: Bearer <jwt>" header
 func (db *DB) DecodeJWTToken(r *http.Request) (*jwt.RegisteredClaims, error) {
 
 	header := r.Header.Get("Authorization")
 	AuthString := strings.Split(header, " ")
+	if len(AuthString) < 2 {
+		return &jwt.RegisteredClaims{}, errNoToken
+	}
 	tokenString := AuthString[1]
 
 	//Parse token string
@@ -26,7 +34,39 @@ func (db *DB) DecodeJWTToken(r *http.Request) (*jwt.RegisteredClaims, error) {
 	claims, ok := token.Claims.(*jwt.RegisteredClaims)
 	if !ok {
 		log.Println("token.Claims not valid")
-		return &jwt.RegisteredClaims{}, err
+		return &jwt.RegisteredClaims{}, errors.New("invalid token claims")
 	}
 	return claims, nil
 }
+
+// authenticate returns the id of the user the request's JWT was issued to
+func (db *DB) authenticate(r *http.Request) (ID, error) {
+	claims, err := db.DecodeJWTToken(r)
+	if err != nil {
+		return 0, err
+	}
+	return ParseID(claims.Subject)
+}
+
+// hasApiKey checks for "Authorization: ApiKey <key>" matching key in constant time,
+// nothing matches an empty key so an unconfigured key locks the endpoint
+func hasApiKey(r *http.Request, key string) bool {
+	AuthString := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(AuthString) < 2 || key == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(AuthString[1]), []byte(key)) == 1
+}
+
+// viewerId is authenticate for endpoints that work without logging in,
+// it returns 0 for anonymous or invalid requests
+func (db *DB) viewerId(r *http.Request) ID {
+	if r.Header.Get("Authorization") == "" {
+		return 0
+	}
+	id, err := db.authenticate(r)
+	if err != nil {
+		return 0
+	}
+	return id
+}
@@ -0,0 +1,278 @@
+package cDatabase
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"internal/api"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	backupPrefix = "chirpy-"
+	backupSuffix = ".json.gz"
+	// backupTimeFormat sorts lexically in time order
+	backupTimeFormat = "20060102T150405.000Z"
+)
+
+var errBadBackupName = errors.New("invalid backup name")
+
+type BackupInfo struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Backup writes a gzip compressed, consistent copy of the dataset to w
+func (db *DB) Backup(w io.Writer) error {
+	// marshal under the read lock, compress after releasing it
+	var dat []byte
+	err := db.View(func(tx *Tx) error {
+		var err error
+		dat, err = json.Marshal(tx.data.DBStructure)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	_, err = gz.Write(dat)
+	if err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Restore replaces the live dataset with a backup written by Backup, or an
+// encrypted one written by CreateBackup. Backups from older schema versions are migrated first.
+func (db *DB) Restore(r io.Reader) error {
+	dat, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	dat, err = db.keys.open(dat)
+	if err != nil {
+		return err
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(dat))
+	if err != nil {
+		return err
+	}
+	dat, err = io.ReadAll(gz)
+	if err != nil {
+		return err
+	}
+
+	dat, reports, err := migrateDocument(dat)
+	if err != nil {
+		return err
+	}
+	for _, report := range reports {
+		log.Printf("Restore: migrated backup v%d -> v%d: %s", report.From, report.To, report.Description)
+	}
+	dbStruct, err := decodeDB(dat)
+	if err != nil {
+		return err
+	}
+	err = dbStruct.validate()
+	if err != nil {
+		return err
+	}
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	err = db.store.Snapshot(dbStruct)
+	if err != nil {
+		return err
+	}
+	db.data = newState(dbStruct)
+	return nil
+}
+
+// CreateBackup writes a timestamped backup into the backup directory,
+// encrypted if a key is configured, and prunes the oldest ones beyond the retention count
+func (db *DB) CreateBackup() (BackupInfo, error) {
+	err := os.MkdirAll(db.backupDir, 0700)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+
+	now := time.Now().UTC()
+	name := backupPrefix + now.Format(backupTimeFormat) + backupSuffix
+
+	var buf bytes.Buffer
+	err = db.Backup(&buf)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	dat, err := db.keys.seal(buf.Bytes())
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	err = writeFileAtomic(filepath.Join(db.backupDir, name), dat, 0600)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+
+	err = db.pruneBackups()
+	if err != nil {
+		log.Print("CreateBackup, pruneBackups:", err.Error())
+	}
+	return BackupInfo{Name: name, Size: int64(len(dat)), CreatedAt: now}, nil
+}
+
+// ListBackups returns the backups in the backup directory, newest first
+func (db *DB) ListBackups() ([]BackupInfo, error) {
+	entries, err := os.ReadDir(db.backupDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []BackupInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := []BackupInfo{}
+	for _, entry := range entries {
+		createdAt, ok := parseBackupName(entry.Name())
+		if !ok || entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, BackupInfo{Name: entry.Name(), Size: info.Size(), CreatedAt: createdAt})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name > result[j].Name })
+	return result, nil
+}
+
+// RestoreBackup restores the named backup from the backup directory
+func (db *DB) RestoreBackup(name string) error {
+	if _, ok := parseBackupName(name); !ok || filepath.Base(name) != name {
+		return errBadBackupName
+	}
+	f, err := os.Open(filepath.Join(db.backupDir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return db.Restore(f)
+}
+
+// pruneBackups keeps the newest db.backupRetain backups, 0 keeps them all
+func (db *DB) pruneBackups() error {
+	if db.backupRetain <= 0 {
+		return nil
+	}
+	backups, err := db.ListBackups()
+	if err != nil {
+		return err
+	}
+	for i := db.backupRetain; i < len(backups); i++ {
+		err = os.Remove(filepath.Join(db.backupDir, backups[i].Name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseBackupName(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupSuffix) {
+		return time.Time{}, false
+	}
+	stamp := strings.TrimSuffix(strings.TrimPrefix(name, backupPrefix), backupSuffix)
+	createdAt, err := time.Parse(backupTimeFormat, stamp)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return createdAt, true
+}
+
+// isAdmin checks for "Authorization: ApiKey <key>" matching the configured admin key,
+// admin endpoints stay locked while no key is configured
+func (db *DB) isAdmin(r *http.Request) bool {
+	return hasApiKey(r, db.adminKey)
+}
+
+// POST /admin/backups -> BackupInfo
+func (db *DB) HandlePostBackup(w http.ResponseWriter, r *http.Request) {
+	if !db.isAdmin(r) {
+		w.WriteHeader(401)
+		return
+	}
+
+	info, err := db.CreateBackup()
+	if err != nil {
+		log.Print("PostBackup, CreateBackup:", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	err = db.sendJson(w, r, info, 201)
+	if err != nil {
+		log.Print("PostBackup, SendJson:", err.Error())
+	}
+}
+
+// GET /admin/backups -> []BackupInfo
+func (db *DB) HandleGetBackups(w http.ResponseWriter, r *http.Request) {
+	if !db.isAdmin(r) {
+		w.WriteHeader(401)
+		return
+	}
+
+	backups, err := db.ListBackups()
+	if err != nil {
+		log.Print("GetBackups, ListBackups:", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	err = db.sendJson(w, r, backups, 200)
+	if err != nil {
+		log.Print("GetBackups, SendJson:", err.Error())
+	}
+}
+
+// POST /admin/backups/{name}/restore
+func (db *DB) HandlePostRestore(w http.ResponseWriter, r *http.Request) {
+	if !db.isAdmin(r) {
+		w.WriteHeader(401)
+		return
+	}
+
+	name := r.PathValue("name")
+	err := db.RestoreBackup(name)
+	if errors.Is(err, errBadBackupName) {
+		w.WriteHeader(400)
+		return
+	}
+	if errors.Is(err, ErrNotFound) {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		log.Print("PostRestore, RestoreBackup:", err.Error())
+		db.sendJson(w, r, api.JsonErr{ErrorMsg: fmt.Sprintf("restore failed: %s", err.Error())}, 500)
+		return
+	}
+
+	log.Printf("PostRestore: restored %s", name)
+	w.WriteHeader(204)
+}
@@ -0,0 +1,136 @@
+package cDatabase
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestBackupRestore takes an encrypted backup, changes the data and restores it,
+// the dataset must come back exactly as it was backed up, in the cache and in the store
+func TestBackupRestore(t *testing.T) {
+	store := newMemStore()
+	cfg := Config{MediaDir: t.TempDir(), BackupDir: t.TempDir(), EncryptionKey: testKey(3)}
+	db, err := NewDBWithStore(store, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		user, err := db.createUser(fmt.Sprintf("user%d@example.com", i), "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		chirp, err := db.CreateChirp(NewChirp{Body: fmt.Sprintf("#backup chirp %d", i), AuthorId: user.Id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.React(bucketLikes, chirp.Id, 1, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.SetFollow(2, 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dump := func(db *DB) string {
+		t.Helper()
+		var dat []byte
+		err := db.View(func(tx *Tx) error {
+			var err error
+			dat, err = json.Marshal(tx.data.DBStructure)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(dat)
+	}
+	want := dump(db)
+
+	info, err := db.CreateBackup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := os.ReadFile(filepath.Join(cfg.BackupDir, info.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.HasPrefix(sealed, []byte{0x1f, 0x8b}) {
+		t.Error("backup written as plain gzip with a key configured")
+	}
+	_, err = db.CreateChirp(NewChirp{Body: "after the backup", AuthorId: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SetFollow(2, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.RestoreBackup(info.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dump(db); got != want {
+		t.Errorf("restored data:\n%s\nwant:\n%s", got, want)
+	}
+	reopened, err := NewDBWithStore(store, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dump(reopened); got != want {
+		t.Errorf("store after restore:\n%s\nwant:\n%s", got, want)
+	}
+	// the indexes were rebuilt for the restored data
+	page, err := db.GetChirps(ChirpQuery{Tag: "backup"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Chirps) != 3 {
+		t.Errorf("%d chirps tagged #backup after restore, want 3", len(page.Chirps))
+	}
+
+	// a plain Backup restores the same way
+	var buf bytes.Buffer
+	err = db.Backup(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh := newTestDB(t, newMemStore())
+	err = fresh.Restore(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dump(fresh); got != want {
+		t.Errorf("Backup into a fresh DB:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// TestAdminKey checks the admin endpoints only open for the configured key
+func TestAdminKey(t *testing.T) {
+	db := newTestDB(t, newMemStore())
+	for _, tc := range []struct {
+		adminKey, header string
+		want             bool
+	}{
+		{"secret", "ApiKey secret", true},
+		{"secret", "ApiKey secreT", false},
+		{"secret", "ApiKey secre", false},
+		{"secret", "", false},
+		{"", "ApiKey ", false},
+	} {
+		db.adminKey = tc.adminKey
+		r := httptest.NewRequest("GET", "/admin/backups", nil)
+		r.Header.Set("Authorization", tc.header)
+		if got := db.isAdmin(r); got != tc.want {
+			t.Errorf("admin key %q, header %q: isAdmin = %v, want %v", tc.adminKey, tc.header, got, tc.want)
+		}
+	}
+}
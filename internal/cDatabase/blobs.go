@@ -0,0 +1,104 @@
+package cDatabase
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// BlobStore keeps uploaded media addressed by the SHA-256 of their content,
+// so identical uploads share one blob. Blobs are immutable,
+// DB deletes one once no chirp refers to it any more.
+type BlobStore interface {
+	// Put stores data and returns its hex encoded hash, storing the same data twice is a no-op
+	Put(data []byte) (string, error)
+	// Open returns the blob with the given hash, ErrNotFound if there is none
+	Open(hash string) (io.ReadSeekCloser, error)
+	// Delete removes the blob with the given hash, deleting a missing blob is a no-op
+	Delete(hash string) error
+}
+
+// fileBlobStore keeps each blob in its own file under dir,
+// fanned out into subdirectories by the first two hex digits of the hash
+type fileBlobStore struct {
+	dir string
+}
+
+func newFileBlobStore(dir string) (*fileBlobStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &fileBlobStore{dir: dir}, nil
+}
+
+func (bs *fileBlobStore) path(hash string) string {
+	return filepath.Join(bs.dir, hash[:2], hash)
+}
+
+// blobHash is the hash a BlobStore files data under
+func blobHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (bs *fileBlobStore) Put(data []byte) (string, error) {
+	hash := blobHash(data)
+	path := bs.path(hash)
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return "", err
+	}
+	err = writeFileAtomic(path, data, 0644)
+	if err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+func (bs *fileBlobStore) Open(hash string) (io.ReadSeekCloser, error) {
+	// the hash comes straight from the URL, never let it name another path
+	if !validBlobHash(hash) {
+		return nil, ErrNotFound
+	}
+	f, err := os.Open(bs.path(hash))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (bs *fileBlobStore) Delete(hash string) error {
+	if !validBlobHash(hash) {
+		return nil
+	}
+	err := os.Remove(bs.path(hash))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// validBlobHash reports whether hash is a lowercase hex SHA-256
+func validBlobHash(hash string) bool {
+	if len(hash) != 2*sha256.Size {
+		return false
+	}
+	for _, c := range hash {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,437 @@
+package cDatabase
+
+import (
+	"errors"
+	"fmt"
+	"internal/api"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Bookmark is a chirp a user saved, to their plain bookmarks when CollectionId is 0
+// or else to one of their collections. Bookmarks outlive the chirp they point at,
+// a deleted chirp stays listed as a tombstone until the user removes it.
+type Bookmark struct {
+	UserId       ID        `json:"user_id"`
+	CollectionId ID        `json:"collection_id,omitempty"`
+	ChirpId      ID        `json:"chirp_id"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Collection is a named, private list of bookmarks
+type Collection struct {
+	Id        ID        `json:"id"`
+	OwnerId   ID        `json:"owner_id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// CollectionResponse is a collection with the number of chirps saved to it
+type CollectionResponse struct {
+	Collection
+	ChirpCount int `json:"chirp_count"`
+}
+
+// BookmarkedChirp is a saved chirp as its owner sees it
+type BookmarkedChirp struct {
+	ChirpResponse
+	BookmarkedAt time.Time `json:"bookmarked_at"`
+}
+
+// BookmarkPage is one page of a bookmark list, most recently saved first.
+// NextCursor is empty on the last page.
+type BookmarkPage struct {
+	Chirps     []BookmarkedChirp `json:"chirps"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+}
+
+// bookmarkList names one list of bookmarks, a user's plain bookmarks or one of their collections
+type bookmarkList struct {
+	userId       ID
+	collectionId ID
+}
+
+// sortByBookmarkedAt tags bookmark cursors so they can't be replayed against GET /api/chirps
+const sortByBookmarkedAt = "bookmarked_at"
+
+const maxCollectionName = 50
+
+var (
+	errBadCollectionName = fmt.Errorf("name must be 1 to %d characters", maxCollectionName)
+	errDuplicateName     = errors.New("a collection with this name already exists")
+)
+
+// bookmarkKey is the key of a bookmark in the bookmarks bucket,
+// one per list and chirp so saving twice changes nothing
+func bookmarkKey(userId, collectionId, chirpId ID) string {
+	return userId.String() + ":" + collectionId.String() + ":" + chirpId.String()
+}
+
+// ownCollection checks that collectionId is 0 or a collection of userId's,
+// collections are private so anyone else's is not found
+func (tx *Tx) ownCollection(collectionId, userId ID) error {
+	if collectionId == 0 {
+		return nil
+	}
+	collection, ok := tx.data.Collections[collectionId]
+	if !ok || collection.OwnerId != userId {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetBookmark saves (on) or removes a chirp in one of userId's lists, collectionId 0
+// for their plain bookmarks. Repeating either is a no-op, and a deleted chirp can
+// still be removed.
+func (db *DB) SetBookmark(userId, collectionId, chirpId ID, on bool) error {
+	return db.Update(func(tx *Tx) error {
+		err := tx.ownCollection(collectionId, userId)
+		if err != nil {
+			return err
+		}
+
+		key := bookmarkKey(userId, collectionId, chirpId)
+		if _, exists := tx.data.Bookmarks[key]; exists == on {
+			return nil
+		}
+		if !on {
+			return tx.del(bucketBookmarks, key)
+		}
+
+		chirp, ok := tx.data.Chirps[chirpId]
+		if !ok {
+			return ErrNotFound
+		}
+		if chirp.hidden() {
+			return ErrGone
+		}
+		return tx.put(bucketBookmarks, key, Bookmark{UserId: userId, CollectionId: collectionId, ChirpId: chirpId, CreatedAt: time.Now().UTC()})
+	})
+}
+
+// GetBookmarks returns one page of one of userId's lists, collectionId 0 for their plain bookmarks
+func (db *DB) GetBookmarks(userId, collectionId ID, limit int, cursor string) (BookmarkPage, error) {
+	after, err := decodeChirpCursor(cursor)
+	if err != nil {
+		return BookmarkPage{}, err
+	}
+	if after != nil && after.SortBy != sortByBookmarkedAt {
+		return BookmarkPage{}, errBadCursor
+	}
+
+	page := BookmarkPage{Chirps: []BookmarkedChirp{}}
+	err = db.View(func(tx *Tx) error {
+		err := tx.ownCollection(collectionId, userId)
+		if err != nil {
+			return err
+		}
+
+		var bookmarks []Bookmark
+		for _, chirpId := range tx.data.bookmarksByList[bookmarkList{userId, collectionId}] {
+			bookmarks = append(bookmarks, tx.data.Bookmarks[bookmarkKey(userId, collectionId, chirpId)])
+		}
+		newer := func(a Bookmark, t time.Time, id ID) bool {
+			if !a.CreatedAt.Equal(t) {
+				return a.CreatedAt.After(t)
+			}
+			return a.ChirpId > id
+		}
+		sort.Slice(bookmarks, func(i, j int) bool {
+			return newer(bookmarks[i], bookmarks[j].CreatedAt, bookmarks[j].ChirpId)
+		})
+		if after != nil {
+			last := Bookmark{ChirpId: after.Id, CreatedAt: after.CreatedAt}
+			bookmarks = bookmarks[sort.Search(len(bookmarks), func(i int) bool {
+				return newer(last, bookmarks[i].CreatedAt, bookmarks[i].ChirpId)
+			}):]
+		}
+		if len(bookmarks) > limit {
+			bookmarks = bookmarks[:limit]
+			last := bookmarks[limit-1]
+			page.NextCursor = encodeChirpCursor(chirpCursor{SortBy: sortByBookmarkedAt, Desc: true, Id: last.ChirpId, CreatedAt: last.CreatedAt})
+		}
+
+		for _, bookmark := range bookmarks {
+			chirp, ok := tx.data.Chirps[bookmark.ChirpId]
+			if !ok {
+				// purged without replies, nothing is left to render but the id
+				chirp = Chirp{Id: bookmark.ChirpId, Deleted: true}
+			}
+			page.Chirps = append(page.Chirps, BookmarkedChirp{ChirpResponse: tx.chirpResponse(chirp, userId), BookmarkedAt: bookmark.CreatedAt})
+		}
+		return nil
+	})
+	return page, err
+}
+
+// CreateCollection adds an empty collection, names are unique per user
+func (db *DB) CreateCollection(userId ID, name string) (Collection, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > maxCollectionName {
+		return Collection{}, errBadCollectionName
+	}
+
+	var result Collection
+	err := db.Update(func(tx *Tx) error {
+		for _, id := range tx.data.collectionsByOwner[userId] {
+			if strings.EqualFold(tx.data.Collections[id].Name, name) {
+				return errDuplicateName
+			}
+		}
+		id, err := tx.nextID(bucketCollections)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		result = Collection{Id: id, OwnerId: userId, Name: name, CreatedAt: now, UpdatedAt: now}
+		return tx.put(bucketCollections, id.String(), result)
+	})
+	return result, err
+}
+
+// GetCollections returns userId's collections by ascending id
+func (db *DB) GetCollections(userId ID) ([]CollectionResponse, error) {
+	result := []CollectionResponse{}
+	err := db.View(func(tx *Tx) error {
+		for _, id := range tx.data.collectionsByOwner[userId] {
+			result = append(result, CollectionResponse{
+				Collection: tx.data.Collections[id],
+				ChirpCount: len(tx.data.bookmarksByList[bookmarkList{userId, id}]),
+			})
+		}
+		return nil
+	})
+	return result, err
+}
+
+// DeleteCollection removes one of userId's collections along with the bookmarks in it
+func (db *DB) DeleteCollection(userId, collectionId ID) error {
+	return db.Update(func(tx *Tx) error {
+		if collectionId == 0 {
+			return ErrNotFound
+		}
+		err := tx.ownCollection(collectionId, userId)
+		if err != nil {
+			return err
+		}
+		for _, chirpId := range idsOf(tx.data.bookmarksByList, bookmarkList{userId, collectionId}) {
+			err := tx.del(bucketBookmarks, bookmarkKey(userId, collectionId, chirpId))
+			if err != nil {
+				return err
+			}
+		}
+		return tx.del(bucketCollections, collectionId.String())
+	})
+}
+
+// PUT /api/bookmarks/{chirpId}, PUT /api/collections/{collectionId}/chirps/{chirpId}
+func (db *DB) HandlePutBookmark(w http.ResponseWriter, r *http.Request) {
+	db.handleBookmark(w, r, true)
+}
+
+// DELETE /api/bookmarks/{chirpId}, DELETE /api/collections/{collectionId}/chirps/{chirpId}
+func (db *DB) HandleDeleteBookmark(w http.ResponseWriter, r *http.Request) {
+	db.handleBookmark(w, r, false)
+}
+
+// parseCollectionId reads the optional {collectionId} path value, 0 on the /api/bookmarks routes
+func parseCollectionId(r *http.Request) (ID, error) {
+	s := r.PathValue("collectionId")
+	if s == "" {
+		return 0, nil
+	}
+	return ParseID(s)
+}
+
+func (db *DB) handleBookmark(w http.ResponseWriter, r *http.Request, on bool) {
+	userId, err := db.authenticate(r)
+	if err != nil {
+		log.Print("Bookmark, authenticate:", err.Error())
+		w.WriteHeader(401)
+		return
+	}
+
+	collectionId, err := parseCollectionId(r)
+	if err != nil {
+		log.Print("Bookmark, ParseID:", err.Error())
+		w.WriteHeader(400)
+		return
+	}
+	chirpId, err := ParseID(r.PathValue("chirpId"))
+	if err != nil {
+		log.Print("Bookmark, ParseID:", err.Error())
+		w.WriteHeader(400)
+		return
+	}
+
+	err = db.SetBookmark(userId, collectionId, chirpId, on)
+	if errors.Is(err, ErrNotFound) {
+		w.WriteHeader(404)
+		return
+	}
+	if errors.Is(err, ErrGone) {
+		w.WriteHeader(410)
+		return
+	}
+	if err != nil {
+		log.Print("Bookmark, SetBookmark:", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// GET /api/bookmarks?limit=&cursor= -> BookmarkPage
+// GET /api/collections/{collectionId}/chirps?limit=&cursor= -> BookmarkPage
+//
+// Bookmark lists are always paged, limit defaults to 20.
+func (db *DB) HandleGetBookmarks(w http.ResponseWriter, r *http.Request) {
+	userId, err := db.authenticate(r)
+	if err != nil {
+		log.Print("GetBookmarks, authenticate:", err.Error())
+		w.WriteHeader(401)
+		return
+	}
+
+	collectionId, err := parseCollectionId(r)
+	if err != nil {
+		log.Print("GetBookmarks, ParseID:", err.Error())
+		w.WriteHeader(400)
+		return
+	}
+
+	query := r.URL.Query()
+	limit, err := parseLimit(query)
+	if err != nil {
+		db.sendJson(w, r, api.JsonErr{ErrorMsg: err.Error()}, 400)
+		return
+	}
+	if limit == 0 {
+		limit = defaultChirpLimit
+	}
+
+	page, err := db.GetBookmarks(userId, collectionId, limit, query.Get("cursor"))
+	if errors.Is(err, errBadCursor) {
+		db.sendJson(w, r, api.JsonErr{ErrorMsg: err.Error()}, 400)
+		return
+	}
+	if errors.Is(err, ErrNotFound) {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		log.Print("GetBookmarks:", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	if page.NextCursor != "" {
+		next := *r.URL
+		values := next.Query()
+		values.Set("cursor", page.NextCursor)
+		values.Set("limit", strconv.Itoa(limit))
+		next.RawQuery = values.Encode()
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.RequestURI()))
+	}
+	err = db.sendJson(w, r, page, 200)
+	if err != nil {
+		log.Print("GetBookmarks, SendJson:", err.Error())
+	}
+}
+
+// { H{"Authorization: Bearer ${jwtToken}"}, {name} } -> Collection
+func (db *DB) HandlePostCollection(w http.ResponseWriter, r *http.Request) {
+	userId, err := db.authenticate(r)
+	if err != nil {
+		log.Print("PostCollection, authenticate:", err.Error())
+		w.WriteHeader(401)
+		return
+	}
+
+	var request struct {
+		Name string `json:"name"`
+	}
+	err = api.RecieveJson(w, r, &request)
+	if err != nil {
+		log.Print("PostCollection, RecieveJson:", err.Error())
+		w.WriteHeader(400)
+		return
+	}
+
+	collection, err := db.CreateCollection(userId, request.Name)
+	if errors.Is(err, errBadCollectionName) {
+		db.sendJson(w, r, api.JsonErr{ErrorMsg: err.Error()}, 400)
+		return
+	}
+	if errors.Is(err, errDuplicateName) {
+		db.sendJson(w, r, api.JsonErr{ErrorMsg: err.Error()}, 409)
+		return
+	}
+	if err != nil {
+		log.Print("PostCollection, CreateCollection:", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	err = db.sendJson(w, r, collection, 201)
+	if err != nil {
+		log.Print("PostCollection, SendJson:", err.Error())
+	}
+}
+
+// GET /api/collections -> []CollectionResponse
+func (db *DB) HandleGetCollections(w http.ResponseWriter, r *http.Request) {
+	userId, err := db.authenticate(r)
+	if err != nil {
+		log.Print("GetCollections, authenticate:", err.Error())
+		w.WriteHeader(401)
+		return
+	}
+
+	collections, err := db.GetCollections(userId)
+	if err != nil {
+		log.Print("GetCollections:", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	err = db.sendJson(w, r, collections, 200)
+	if err != nil {
+		log.Print("GetCollections, SendJson:", err.Error())
+	}
+}
+
+// DELETE /api/collections/{collectionId}
+func (db *DB) HandleDeleteCollection(w http.ResponseWriter, r *http.Request) {
+	userId, err := db.authenticate(r)
+	if err != nil {
+		log.Print("DeleteCollection, authenticate:", err.Error())
+		w.WriteHeader(401)
+		return
+	}
+
+	collectionId, err := ParseID(r.PathValue("collectionId"))
+	if err != nil {
+		log.Print("DeleteCollection, ParseID:", err.Error())
+		w.WriteHeader(400)
+		return
+	}
+
+	err = db.DeleteCollection(userId, collectionId)
+	if errors.Is(err, ErrNotFound) {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		log.Print("DeleteCollection:", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(204)
+}
@@ -1,116 +1,509 @@
 package cDatabase
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"internal/api"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"slices"
 	"sort"
 	"strconv"
 	"time"
+	"unicode/utf8"
 )
 
-// CreateChirp creates a new chirp and saves it to disk
-func (db *DB) CreateChirp(body string, userId int) (Chirp, error) {
+// Sort keys for ChirpQuery.SortBy
+const (
+	SortById        = "id"
+	SortByCreatedAt = "created_at"
+)
+
+// ChirpQuery filters and orders GetChirps, the zero value lists every chirp by ascending id
+type ChirpQuery struct {
+	// AuthorId limits results to one author, 0 for all
+	AuthorId ID
+	// Tag limits results to chirps carrying a lowercased tag, MentionId to chirps
+	// mentioning a user, empty or 0 for all
+	Tag       string
+	MentionId ID
+	// LikedBy limits results to chirps a user liked, 0 for all
+	LikedBy ID
+	// TimelineOf limits results to chirps by a user and everyone they follow, 0 for all
+	TimelineOf ID
+	// QuoteOf limits results to chirps quoting a chirp, 0 for all
+	QuoteOf ID
+	// Viewer is the user the results are rendered for, 0 for anonymous
+	Viewer ID
+	// Since (inclusive) and Until (exclusive) bound created_at, zero for no bound
+	Since time.Time
+	Until time.Time
+	// SortBy is SortById (default) or SortByCreatedAt. Both give the same order,
+	// created_at never decreases with id, but cursors only work for the sort they came from.
+	SortBy string
+	Desc   bool
+	// Limit caps the page size, 0 for no limit. HTTP handlers always set one.
+	// Cursor is a ChirpPage.NextCursor from the same query, empty for the first page
+	Limit  int
+	Cursor string
+}
+
+// ChirpPage is one page of GetChirps,
+// NextCursor is empty on the last page
+type ChirpPage struct {
+	Chirps     []ChirpResponse `json:"chirps"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+// Page sizes for GET /api/chirps
+const (
+	defaultChirpLimit = 20
+	maxChirpLimit     = 100
+)
+
+var errBadCursor = errors.New("cursor is invalid or belongs to a different sort")
+
+// chirpCursor is the position of the last chirp on a page, along with the
+// order it was taken in. Positions are keys rather than offsets so a page
+// doesn't shift when new chirps arrive.
+type chirpCursor struct {
+	SortBy    string    `json:"s"`
+	Desc      bool      `json:"d,omitempty"`
+	Id        ID        `json:"i"`
+	CreatedAt time.Time `json:"t"`
+}
 
-	dbStruct, err := db.loadDB()
+// encodeChirpCursor makes c opaque to clients
+func encodeChirpCursor(c chirpCursor) string {
+	dat, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(dat)
+}
+
+// decodeChirpCursor returns nil for an empty cursor
+func decodeChirpCursor(s string) (*chirpCursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	dat, err := base64.RawURLEncoding.DecodeString(s)
 	if err != nil {
-		log.Fatal(err)
+		return nil, errBadCursor
 	}
+	var c chirpCursor
+	err = json.Unmarshal(dat, &c)
+	if err != nil {
+		return nil, errBadCursor
+	}
+	return &c, nil
+}
 
-	id := len(dbStruct.Chirps) + 1
-	result := Chirp{Id: id, Body: body, AuthorId: userId}
-	dbStruct.Chirps[id] = result
+// NewChirp is what a client supplies to create a chirp
+type NewChirp struct {
+	Body     string
+	AuthorId ID
+	// InReplyTo is the chirp this one answers, 0 to start a new conversation
+	InReplyTo ID
+	// QuoteOf is the chirp this one quotes, 0 for none
+	QuoteOf ID
+	// Images come from PrepareImage, their blobs are stored once the chirp passes validation
+	Images []Image
+	// Poll is built by newPoll, nil for a chirp without one
+	Poll *Poll
+}
+
+var (
+	errBadReply       = errors.New("in_reply_to must be an existing chirp")
+	errChirpTooLong   = errors.New("Chirp is too long")
+	errBlockedContent = errors.New("Chirp contains blocked content")
+)
 
-	db.writeDB(dbStruct)
+// CreateChirp creates a new chirp and saves it to disk
+func (db *DB) CreateChirp(c NewChirp) (Chirp, error) {
+	var result Chirp
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		result, err = tx.createChirp(c)
+		return err
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
 
 	return result, nil
 }
 
-// GetChirps returns all chirps in the database
-// idQuery optional
-func (db *DB) GetChirps(idQuery string) ([]Chirp, error) {
-	var result []Chirp
+// createChirp is CreateChirp inside a transaction, for callers that change other records alongside it
+func (tx *Tx) createChirp(c NewChirp) (Chirp, error) {
+	body, flagged, err := tx.checkBody(tx.rewriteMentions(c.Body))
+	if err != nil {
+		return Chirp{}, err
+	}
+	err = tx.checkReply(c.InReplyTo)
+	if err != nil {
+		return Chirp{}, err
+	}
+	err = tx.checkQuote(c.QuoteOf)
+	if err != nil {
+		return Chirp{}, err
+	}
 
-	id := 0
-	if idQuery != "" {
-		result, err := strconv.Atoi(idQuery)
-		if err != nil {
-			return []Chirp{}, errors.New("GetChirps id conv -> int error")
-		}
-		id = result
+	attachments, err := tx.storeImages(c.Images)
+	if err != nil {
+		return Chirp{}, err
 	}
+	id, err := tx.nextID(bucketChirps)
+	if err != nil {
+		return Chirp{}, err
+	}
+	// a clock step backwards must not put a new chirp before older ids
+	now := time.Now().UTC()
+	if now.Before(tx.data.latestChirpAt) {
+		now = tx.data.latestChirpAt
+	}
+	result := Chirp{
+		Id:          id,
+		Body:        body,
+		AuthorId:    c.AuthorId,
+		InReplyTo:   c.InReplyTo,
+		QuoteOf:     c.QuoteOf,
+		Tags:        extractTags(body),
+		Mentions:    tx.resolveMentions(body),
+		Attachments: attachments,
+		Poll:        c.Poll,
+		Flagged:     flagged,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	return result, tx.put(bucketChirps, id.String(), result)
+}
 
-	dbStruct, err := db.loadDB()
+// checkBody enforces api.MaxChirpLength and runs body through the content filter.
+// It returns the body with masked words replaced and whether a rule flagged it.
+func (tx *Tx) checkBody(body string) (string, bool, error) {
+	if utf8.RuneCountInString(body) > api.MaxChirpLength {
+		return "", false, errChirpTooLong
+	}
+	result := tx.filter.Check(body)
+	if result.Rejected {
+		return "", false, errBlockedContent
+	}
+	return result.Text, result.Flagged, nil
+}
+
+// checkReply returns errBadReply unless parentId is 0 or a live chirp
+func (tx *Tx) checkReply(parentId ID) error {
+	if parentId == 0 {
+		return nil
+	}
+	parent, ok := tx.data.Chirps[parentId]
+	if !ok || parent.hidden() {
+		return errBadReply
+	}
+	return nil
+}
+
+// GetChirps returns one page of the chirps matching q in the order q asks for,
+// every matching chirp if q.Limit is 0
+func (db *DB) GetChirps(q ChirpQuery) (ChirpPage, error) {
+	after, err := decodeChirpCursor(q.Cursor)
 	if err != nil {
-		return result, err
+		return ChirpPage{}, err
+	}
+	if after != nil && (after.SortBy != q.SortBy || after.Desc != q.Desc) {
+		return ChirpPage{}, errBadCursor
 	}
 
-	if id == 0 {
-		for _, item := range dbStruct.Chirps {
-			result = append(result, item)
+	var page ChirpPage
+	err = db.View(func(tx *Tx) error {
+		// every index is in id order, which is created_at order too
+		var result []Chirp
+		if q.TimelineOf != 0 {
+			result = q.walk(tx, tx.timelineWalker(q.TimelineOf, q.Desc, after))
+		} else {
+			result = q.walkIds(tx, q.candidates(tx), after)
 		}
-	} else {
-		for _, item := range dbStruct.Chirps {
-			if item.AuthorId == id {
-				result = append(result, item)
+
+		if q.Limit > 0 && len(result) > q.Limit {
+			result = result[:q.Limit]
+			last := result[q.Limit-1]
+			page.NextCursor = encodeChirpCursor(chirpCursor{SortBy: q.SortBy, Desc: q.Desc, Id: last.Id, CreatedAt: last.CreatedAt})
+		}
+		page.Chirps = tx.chirpResponses(result, q.Viewer)
+		return nil
+	})
+	return page, err
+}
+
+// walkIds pages through the id-ordered index ids starting after the cursor,
+// it stops one past q.Limit so the caller knows whether there is a next page
+func (q ChirpQuery) walkIds(tx *Tx, ids []ID, after *chirpCursor) []Chirp {
+	return q.walk(tx, idWalker(ids, q.Desc, after))
+}
+
+// walk collects the chirps matching q from next, stopping one past q.Limit
+func (q ChirpQuery) walk(tx *Tx, next func() (ID, bool)) []Chirp {
+	result := []Chirp{}
+	for q.Limit == 0 || len(result) <= q.Limit {
+		id, ok := next()
+		if !ok {
+			break
+		}
+		if chirp := tx.data.Chirps[id]; q.matches(tx, chirp) {
+			result = append(result, chirp)
+		}
+	}
+	return result
+}
+
+// idWalker hands out the ascending ids one at a time, starting after the cursor
+// and going down instead if desc is set
+func idWalker(ids []ID, desc bool, after *chirpCursor) func() (ID, bool) {
+	if desc {
+		i := len(ids)
+		if after != nil {
+			i = sort.Search(len(ids), func(i int) bool { return ids[i] >= after.Id })
+		}
+		return func() (ID, bool) {
+			if i == 0 {
+				return 0, false
 			}
+			i--
+			return ids[i], true
 		}
 	}
 
-	return result, nil
+	i := 0
+	if after != nil {
+		i = sort.Search(len(ids), func(i int) bool { return ids[i] > after.Id })
+	}
+	return func() (ID, bool) {
+		if i == len(ids) {
+			return 0, false
+		}
+		i++
+		return ids[i-1], true
+	}
+}
+
+// candidates picks the shortest index list that every match of q is in
+func (q ChirpQuery) candidates(tx *Tx) []ID {
+	ids := tx.data.chirpIds
+	narrow := func(list []ID) {
+		if len(list) < len(ids) {
+			ids = list
+		}
+	}
+	if q.AuthorId != 0 {
+		narrow(tx.data.chirpsByAuthor[q.AuthorId])
+	}
+	if q.Tag != "" {
+		narrow(tx.data.chirpsByTag[q.Tag])
+	}
+	if q.MentionId != 0 {
+		narrow(tx.data.chirpsByMention[q.MentionId])
+	}
+	if q.LikedBy != 0 {
+		narrow(tx.data.likesByUser[q.LikedBy])
+	}
+	if q.QuoteOf != 0 {
+		narrow(tx.data.quotesOf[q.QuoteOf])
+	}
+	return ids
+}
+
+func (q ChirpQuery) matches(tx *Tx, chirp Chirp) bool {
+	// liked chirps come from likesByUser, which still lists trashed ones
+	if chirp.hidden() {
+		return false
+	}
+	if q.AuthorId != 0 && chirp.AuthorId != q.AuthorId {
+		return false
+	}
+	if q.Tag != "" && !slices.Contains(chirp.Tags, q.Tag) {
+		return false
+	}
+	if q.MentionId != 0 && !slices.Contains(chirp.Mentions, q.MentionId) {
+		return false
+	}
+	if _, ok := tx.data.Likes[reactionKey(chirp.Id, q.LikedBy)]; q.LikedBy != 0 && !ok {
+		return false
+	}
+	if _, ok := tx.data.Follows[followKey(q.TimelineOf, chirp.AuthorId)]; q.TimelineOf != 0 && chirp.AuthorId != q.TimelineOf && !ok {
+		return false
+	}
+	if q.QuoteOf != 0 && chirp.QuoteOf != q.QuoteOf {
+		return false
+	}
+	if !q.Since.IsZero() && chirp.CreatedAt.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !chirp.CreatedAt.Before(q.Until) {
+		return false
+	}
+	return true
 }
 
-// GetChirps returns all chirps in the database
-func (db *DB) GetChirp(id int) (Chirp, error) {
+// parseChirpQuery reads author_id, since, until (RFC 3339), sort (asc|desc),
+// sort_by (id|created_at), limit and cursor from the query string
+func parseChirpQuery(r *http.Request) (ChirpQuery, error) {
+	query := r.URL.Query()
+	var q ChirpQuery
+	var err error
+
+	if s := query.Get("author_id"); s != "" {
+		q.AuthorId, err = ParseID(s)
+		if err != nil {
+			return q, errors.New("author_id must be a chirpy id")
+		}
+	}
+	if s := query.Get("since"); s != "" {
+		q.Since, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			return q, errors.New("since must be an RFC 3339 time")
+		}
+	}
+	if s := query.Get("until"); s != "" {
+		q.Until, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			return q, errors.New("until must be an RFC 3339 time")
+		}
+	}
+
+	switch query.Get("sort") {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, errors.New("sort must be asc or desc")
+	}
+
+	switch query.Get("sort_by") {
+	case "", SortById:
+		q.SortBy = SortById
+	case SortByCreatedAt:
+		q.SortBy = SortByCreatedAt
+	default:
+		return q, errors.New("sort_by must be id or created_at")
+	}
 
-	dbStruct, err := db.loadDB()
+	q.Cursor = query.Get("cursor")
+	q.Limit, err = parseLimit(query)
 	if err != nil {
-		return Chirp{}, err
+		return q, err
 	}
+	if q.Limit == 0 && q.Cursor != "" {
+		q.Limit = defaultChirpLimit
+	}
+	return q, nil
+}
 
-	chirp, ok := dbStruct.Chirps[id]
-	if ok {
-		return chirp, nil
+// parseLimit reads limit from the query string, 0 when it isn't given
+func parseLimit(query url.Values) (int, error) {
+	s := query.Get("limit")
+	if s == "" {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit < 1 || limit > maxChirpLimit {
+		return 0, fmt.Errorf("limit must be between 1 and %d", maxChirpLimit)
 	}
+	return limit, nil
+}
 
-	return Chirp{}, errors.New("id ${id} not found")
+// GetChirp returns the chirp with the given id as viewer sees it
+func (db *DB) GetChirp(id, viewer ID) (ChirpResponse, error) {
+	var result ChirpResponse
+	err := db.View(func(tx *Tx) error {
+		chirp, ok := tx.data.Chirps[id]
+		if !ok {
+			return ErrNotFound
+		}
+		if chirp.hidden() {
+			return ErrGone
+		}
+		result = tx.chirpResponse(chirp, viewer)
+		return nil
+	})
+	return result, err
 }
 
 func (db *DB) HandleGetChirpRequest(w http.ResponseWriter, r *http.Request) {
 
 	pathVal := r.PathValue("chirpId")
-	id, err := strconv.Atoi(pathVal)
+	id, err := ParseID(pathVal)
 	if err != nil {
 		log.Print("getChirpById, strconv err ", err.Error())
 	}
 
-	chirp, err := db.GetChirp(id)
+	chirp, err := db.GetChirp(id, db.viewerId(r))
+	if errors.Is(err, ErrGone) {
+		w.WriteHeader(410)
+		return
+	}
 	if err != nil {
 		w.WriteHeader(404)
 		return
 	}
 
-	err = api.SendJson(w, r, chirp, 200)
+	err = db.sendJson(w, r, chirp, 200)
 	if err != nil {
 		log.Print("getChirpById, SendJSON ", err.Error())
 	}
 }
 
+// GET /api/chirps -> []Chirp, or a ChirpPage when limit or cursor is given.
+// Either way at most defaultChirpLimit chirps come back unless limit asks for more.
 func (db *DB) HandleGetChirpsRequest(w http.ResponseWriter, r *http.Request) {
-	id := r.URL.Query().Get("author_id")
-	sortQuery := r.URL.Query().Get("sort")
-	chirps, err := db.GetChirps(id)
+	q, err := parseChirpQuery(r)
 	if err != nil {
-		log.Fatal(err)
+		db.sendJson(w, r, api.JsonErr{ErrorMsg: err.Error()}, 400)
+		return
 	}
-	if sortQuery == "desc" {
-		sort.Slice(chirps, func(i, j int) bool { return chirps[i].Id > chirps[j].Id })
-	} else {
-		sort.Slice(chirps, func(i, j int) bool { return chirps[i].Id < chirps[j].Id })
+
+	db.serveChirps(w, r, q)
+}
+
+// serveChirps answers a chirp listing request with the results of q,
+// rendered for the logged in user if there is one
+func (db *DB) serveChirps(w http.ResponseWriter, r *http.Request, q ChirpQuery) {
+	q.Viewer = db.viewerId(r)
+	bare := q.Limit == 0
+	if bare {
+		q.Limit = maxChirpLimit
+	}
+	page, err := db.GetChirps(q)
+	if errors.Is(err, errBadCursor) {
+		db.sendJson(w, r, api.JsonErr{ErrorMsg: err.Error()}, 400)
+		return
+	}
+	if err != nil {
+		log.Print("GetChirps", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+	// plain clients that never asked for paging get every match as a bare array,
+	// or an error rather than a silently truncated list
+	if bare && page.NextCursor != "" {
+		db.sendJson(w, r, api.JsonErr{ErrorMsg: fmt.Sprintf("more than %d chirps match, page through them with limit and cursor", maxChirpLimit)}, 400)
+		return
 	}
 
-	err = api.SendJson(w, r, chirps, 200)
+	if page.NextCursor != "" {
+		next := *r.URL
+		values := next.Query()
+		values.Set("cursor", page.NextCursor)
+		values.Set("limit", strconv.Itoa(q.Limit))
+		next.RawQuery = values.Encode()
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.RequestURI()))
+	}
+	if bare {
+		err = db.sendJson(w, r, page.Chirps, 200)
+	} else {
+		err = db.sendJson(w, r, page, 200)
+	}
 	if err != nil {
 		log.Print("GetChirps SendJson", err.Error())
 	}
@@ -132,26 +525,66 @@ func (db *DB) HandlePostChirpsRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var respBody response
-	err = api.RecieveJson(w, r, &respBody)
-	if err != nil {
-		log.Print(err.Error())
-		w.WriteHeader(500)
-	}
-
-	authorId, err := strconv.Atoi(claims.Subject)
+	authorId, err := ParseID(claims.Subject)
 	if err != nil {
 		log.Print("POST Chirps, strconv uId -> int", err.Error())
 		w.WriteHeader(400)
 		return
 	}
 
-	chirp, err := db.CreateChirp(respBody.Body, authorId) //Pass user id
+	// images come in as multipart/form-data, plain chirps as JSON
+	var newChirp NewChirp
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		newChirp, err = db.receiveChirpForm(w, r)
+		if status := mediaErrorStatus(err); status != 0 {
+			db.sendJson(w, r, api.JsonErr{ErrorMsg: err.Error()}, status)
+			return
+		}
+		if errors.Is(err, errBadReply) || errors.Is(err, errBadQuote) {
+			db.sendJson(w, r, api.JsonErr{ErrorMsg: err.Error()}, 400)
+			return
+		}
+		if err != nil {
+			log.Print("PostChirps, receiveChirpForm:", err.Error())
+			w.WriteHeader(400)
+			return
+		}
+	} else {
+		var respBody response
+		err = api.RecieveJson(w, r, &respBody)
+		if err != nil {
+			log.Print(err.Error())
+			w.WriteHeader(500)
+			return
+		}
+		newChirp = NewChirp{Body: respBody.Body, InReplyTo: respBody.InReplyTo, QuoteOf: respBody.QuoteOf}
+		if respBody.Poll != nil {
+			newChirp.Poll, err = newPoll(*respBody.Poll)
+			if err != nil {
+				db.sendJson(w, r, api.JsonErr{ErrorMsg: err.Error()}, 400)
+				return
+			}
+		}
+	}
+	newChirp.AuthorId = authorId
+
+	chirp, err := db.CreateChirp(newChirp)
+	if errors.Is(err, errBadReply) || errors.Is(err, errBadQuote) || errors.Is(err, errChirpTooLong) || errors.Is(err, errBlockedContent) {
+		db.sendJson(w, r, api.JsonErr{ErrorMsg: err.Error()}, 400)
+		return
+	}
 	if err != nil {
-		log.Fatal(err)
+		log.Print("PostChirps, CreateChirp:", err.Error())
+		w.WriteHeader(500)
+		return
 	}
 
-	err = api.SendJson(w, r, chirp, 201)
+	var result ChirpResponse
+	db.View(func(tx *Tx) error {
+		result = tx.chirpResponse(chirp, authorId)
+		return nil
+	})
+	err = db.sendJson(w, r, result, 201)
 	if err != nil {
 		log.Print("postChirp sendJson:", err.Error())
 		w.WriteHeader(500)
@@ -168,7 +601,7 @@ func (db *DB) HandleDeleteChirpsRequest(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	claimId, err := strconv.Atoi(claims.Subject)
+	claimId, err := ParseID(claims.Subject)
 	if err != nil {
 		log.Print("DELETE chirp request, str conv subject -> int", err.Error())
 		w.WriteHeader(400)
@@ -176,41 +609,81 @@ func (db *DB) HandleDeleteChirpsRequest(w http.ResponseWriter, r *http.Request)
 	}
 
 	pathVal := r.PathValue("chirpId")
-	chirId, err := strconv.Atoi(pathVal)
+	chirId, err := ParseID(pathVal)
 	if err != nil {
 		log.Print("getChirpById, strconv err ", err.Error())
 		w.WriteHeader(400)
 		return
 	}
 
-	dbStruct, err := db.loadDB()
-	if err != nil {
-		log.Print("del chirp req, load db", err.Error())
-		w.WriteHeader(400)
-		return
-	}
-	chirp, ok := dbStruct.Chirps[chirId]
-	if !ok {
+	err = db.DeleteChirp(chirId, claimId)
+	if errors.Is(err, ErrNotFound) {
 		log.Print("Chirp id not found")
 		w.WriteHeader(400)
 		return
 	}
-
-	if chirp.AuthorId != claimId {
-		log.Print("Chirp id not found")
+	if errors.Is(err, ErrForbidden) {
+		log.Print("Chirp author mismatch")
 		w.WriteHeader(403)
 		return
 	}
-	db.DeleteChirp(chirId)
+	if errors.Is(err, ErrGone) {
+		w.WriteHeader(410)
+		return
+	}
+	if err != nil {
+		log.Print("del chirp req, DeleteChirp", err.Error())
+		w.WriteHeader(500)
+		return
+	}
 	w.WriteHeader(204)
 }
 
-func (db *DB) DeleteChirp(chirpId int) {
-	dbStruct, err := db.loadDB()
-	if err != nil {
-		log.Print("DeleteChirp(), load db", err.Error())
-		return
+// DeleteChirp moves a chirp to the trash, userId must be its author.
+// It disappears from every listing at once but can be restored with RestoreChirp
+// until the sweeper purges it.
+func (db *DB) DeleteChirp(chirpId, userId ID) error {
+	return db.Update(func(tx *Tx) error {
+		chirp, err := tx.ownChirp(chirpId, userId)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		chirp.DeletedAt = &now
+		return tx.put(bucketChirps, chirpId.String(), chirp)
+	})
+}
+
+// ownChirp returns a live chirp that userId is allowed to change, only its author is
+func (tx *Tx) ownChirp(chirpId, userId ID) (Chirp, error) {
+	chirp, ok := tx.data.Chirps[chirpId]
+	if !ok {
+		return Chirp{}, ErrNotFound
+	}
+	if chirp.hidden() {
+		return Chirp{}, ErrGone
+	}
+	if chirp.AuthorId != userId {
+		return Chirp{}, ErrForbidden
+	}
+	return chirp, nil
+}
+
+// hidden reports whether chirp is in the trash or purged,
+// either way only its tombstone is shown
+func (chirp Chirp) hidden() bool {
+	return chirp.DeletedAt != nil || chirp.Deleted
+}
+
+// tombstone is what a deleted chirp shows in threads,
+// and all that remains of a purged chirp that still has replies
+func tombstone(chirp Chirp) Chirp {
+	return Chirp{
+		Id:        chirp.Id,
+		InReplyTo: chirp.InReplyTo,
+		Deleted:   true,
+		CreatedAt: chirp.CreatedAt,
+		UpdatedAt: chirp.UpdatedAt,
+		DeletedAt: chirp.DeletedAt,
 	}
-	delete(dbStruct.Chirps, chirpId)
-	db.writeDB(dbStruct)
 }
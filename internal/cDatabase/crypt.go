@@ -0,0 +1,153 @@
+package cDatabase
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// sealedMagic starts every encrypted file,
+// followed by the key id, the nonce and the AES-GCM ciphertext
+var sealedMagic = []byte("CHIRPYENC\x01")
+
+const keyIDLen = 8
+
+var errNoKey = errors.New("database is encrypted but no DB_ENCRYPTION_KEY is set")
+
+// keyring seals with the current key and opens with any known key,
+// so rotating is a matter of moving the old key to the previous list and restarting.
+// A nil keyring stores plaintext.
+type keyring struct {
+	currentID string
+	aeads     map[string]cipher.AEAD
+}
+
+// newKeyring parses base64 encoded 32 byte keys, it returns nil if current is empty
+func newKeyring(current string, previous []string) (*keyring, error) {
+	if current == "" {
+		if len(previous) > 0 {
+			return nil, errors.New("previous encryption keys set without a current key")
+		}
+		return nil, nil
+	}
+
+	k := &keyring{aeads: make(map[string]cipher.AEAD)}
+	for i, encoded := range append([]string{current}, previous...) {
+		id, aead, err := parseKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %d: %w", i, err)
+		}
+		if i == 0 {
+			k.currentID = id
+		}
+		k.aeads[id] = aead
+	}
+	return k, nil
+}
+
+func parseKey(encoded string) (string, cipher.AEAD, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(key) != 32 {
+		return "", nil, fmt.Errorf("want 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", nil, err
+	}
+	sum := sha256.Sum256(key)
+	return string(sum[:keyIDLen]), aead, nil
+}
+
+// seal encrypts plain with the current key
+func (k *keyring) seal(plain []byte) ([]byte, error) {
+	if k == nil {
+		return plain, nil
+	}
+	aead := k.aeads[k.currentID]
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]byte, 0, len(sealedMagic)+keyIDLen+len(nonce)+len(plain)+aead.Overhead())
+	result = append(result, sealedMagic...)
+	result = append(result, k.currentID...)
+	result = append(result, nonce...)
+	// the header is authenticated along with the data
+	return aead.Seal(result, nonce, plain, result), nil
+}
+
+// open decrypts dat with whichever key sealed it, plaintext passes through untouched
+func (k *keyring) open(dat []byte) ([]byte, error) {
+	if !bytes.HasPrefix(dat, sealedMagic) {
+		return dat, nil
+	}
+	if k == nil {
+		return nil, errNoKey
+	}
+
+	headerLen := len(sealedMagic) + keyIDLen
+	if len(dat) < headerLen {
+		return nil, errors.New("sealed data too short")
+	}
+	aead, ok := k.aeads[string(dat[len(sealedMagic):headerLen])]
+	if !ok {
+		return nil, errors.New("sealed with an unknown encryption key")
+	}
+	if len(dat) < headerLen+aead.NonceSize() {
+		return nil, errors.New("sealed data too short")
+	}
+	nonce := dat[headerLen : headerLen+aead.NonceSize()]
+	return aead.Open(nil, nonce, dat[headerLen+aead.NonceSize():], dat[:headerLen+aead.NonceSize()])
+}
+
+// isCurrent reports whether dat is already in the form seal would produce,
+// plaintext when there is no key or sealed with the current key
+func (k *keyring) isCurrent(dat []byte) bool {
+	if k == nil {
+		return !bytes.HasPrefix(dat, sealedMagic)
+	}
+	headerLen := len(sealedMagic) + keyIDLen
+	return bytes.HasPrefix(dat, sealedMagic) && len(dat) >= headerLen && string(dat[len(sealedMagic):headerLen]) == k.currentID
+}
+
+// sealLine seals one journal line, base64 encoded so it stays newline free
+func (k *keyring) sealLine(plain []byte) ([]byte, error) {
+	if k == nil {
+		return plain, nil
+	}
+	sealed, err := k.seal(plain)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]byte, base64.StdEncoding.EncodedLen(len(sealed)))
+	base64.StdEncoding.Encode(result, sealed)
+	return result, nil
+}
+
+// openLine reverses sealLine, plaintext JSON lines pass through
+func (k *keyring) openLine(line []byte) ([]byte, error) {
+	if bytes.HasPrefix(line, []byte("{")) {
+		return line, nil
+	}
+	sealed := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+	n, err := base64.StdEncoding.Decode(sealed, line)
+	if err != nil {
+		return nil, err
+	}
+	return k.open(sealed[:n])
+}
@@ -0,0 +1,96 @@
+package cDatabase
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+// TestKeyRotation writes with one key, reopens with a new key and the old one as previous,
+// and checks the file and journal are re-encrypted so the new key alone opens them
+func TestKeyRotation(t *testing.T) {
+	oldKey, newKey := testKey(1), testKey(2)
+	path := filepath.Join(t.TempDir(), "database.json")
+	open := func(key string, previous ...string) (*DB, error) {
+		return NewDB(Config{Path: path, EncryptionKey: key, PreviousEncryptionKeys: previous, MediaDir: t.TempDir()})
+	}
+
+	db, err := open(oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.createUser("folded@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.store.Close()
+	// left in the journal as if the server had stopped without compacting
+	_, err = db.createUser("journalled@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{path, path + ".wal"} {
+		dat, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(dat, []byte("@example.com")) {
+			t.Fatalf("%s holds plaintext", filepath.Base(p))
+		}
+	}
+
+	db, err = open(newKey, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.store.Close()
+
+	_, err = open(oldKey)
+	if err == nil {
+		t.Error("old key still opens the database after rotation")
+	}
+	db, err = open(newKey)
+	if err != nil {
+		t.Fatalf("new key alone: %v", err)
+	}
+	for _, email := range []string{"folded@example.com", "journalled@example.com"} {
+		db.View(func(tx *Tx) error {
+			if _, ok := tx.userByEmail(email); !ok {
+				t.Errorf("%s lost in rotation", email)
+			}
+			return nil
+		})
+	}
+}
+
+// TestSQLiteRefusesKey checks the sqlite backend fails instead of storing plaintext
+// and keeps its files private
+func TestSQLiteRefusesKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.sqlite")
+	_, err := OpenStore(Config{Backend: BackendSQLite, Path: path, EncryptionKey: testKey(1)})
+	if err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Errorf("sqlite with a key: got %v, want an error", err)
+	}
+
+	store, err := OpenStore(Config{Backend: BackendSQLite, Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for _, p := range []string{path, path + "-wal", path + "-shm"} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != 0600 {
+			t.Errorf("%s has mode %v, want 0600", filepath.Base(p), mode)
+		}
+	}
+}
@@ -2,101 +2,441 @@ package cDatabase
 
 import (
 	"encoding/json"
+	"fmt"
+	"internal/api"
 	"log"
-	"os"
 	"sync"
 	"time"
 )
 
+// Chirp is a post, Tags are the lowercased #tags in Body
+// and Mentions the users its @mentions resolved to.
+// A deleted chirp sits in its author's trash until it is restored or purged,
+// see DeleteChirp and purgeChirp; Deleted marks what remains after the purge.
+// LikeCount and RechirpCount move in the same transaction as the reactions
+// they count. EditedAt is only set once the body has been edited, see EditChirp.
+// Poll is set when the chirp asks a question, see CastVote.
 type Chirp struct {
-	Id       int    `json:"id"`
-	Body     string `json:"body"`
-	AuthorId int    `json:"author_id"`
+	Id           ID           `json:"id"`
+	Body         string       `json:"body"`
+	AuthorId     ID           `json:"author_id"`
+	InReplyTo    ID           `json:"in_reply_to,omitempty"`
+	QuoteOf      ID           `json:"quote_of,omitempty"`
+	Deleted      bool         `json:"deleted,omitempty"`
+	LikeCount    int          `json:"like_count"`
+	RechirpCount int          `json:"rechirp_count"`
+	Tags         []string     `json:"tags,omitempty"`
+	Mentions     []ID         `json:"mentions,omitempty"`
+	Attachments  []Attachment `json:"attachments,omitempty"`
+	Poll         *Poll        `json:"poll,omitempty"`
+	CreatedAt    time.Time    `json:"created_at"`
+	UpdatedAt    time.Time    `json:"updated_at"`
+	EditedAt     *time.Time   `json:"edited_at,omitempty"`
+	DeletedAt    *time.Time   `json:"deleted_at,omitempty"`
+	// Flagged is set when the content filter wants the chirp reviewed
+	Flagged bool `json:"flagged,omitempty"`
 }
 
 type response struct {
-	Body string `json:"body"`
+	Body      string       `json:"body"`
+	InReplyTo ID           `json:"in_reply_to"`
+	QuoteOf   ID           `json:"quote_of"`
+	Poll      *pollRequest `json:"poll"`
 }
 
 type DB struct {
-	path     string
+	store Store
+	// data caches the whole dataset, reads never touch the store
+	data     *state
 	mux      *sync.RWMutex
 	secret   string
 	polkaApi string
+	idMode   string
+
+	backupDir    string
+	backupRetain int
+	adminKey     string
+	// keys encrypts backup files, nil writes them in plaintext
+	keys *keyring
+
+	blobs  BlobStore
+	filter *api.ContentFilter
+
+	sweepInterval    time.Duration
+	webhookRetention time.Duration
+	sweeper          sweeper
+
+	scheduleInterval time.Duration
+
+	editWindow     time.Duration
+	editWindowRed  time.Duration
+	trashRetention time.Duration
+}
+
+// Database backends selectable in Config.Backend
+const (
+	BackendJSON   = "json"
+	BackendMemory = "memory"
+	BackendSQLite = "sqlite"
+)
+
+// Config selects and configures the database backend
+type Config struct {
+	// Backend is one of BackendJSON (default), BackendMemory or BackendSQLite
+	Backend string
+	// Path is the database file, unused by BackendMemory
+	Path string
+	// Reset wipes any existing data on startup, meant for dev only
+	Reset bool
+	// IDMode is IDSequence (default) or IDSnowflake
+	IDMode string
+	// EncryptionKey is a base64 encoded 32 byte AES key for the JSON file, its journal and backups.
+	// To rotate, set a new key and move the old one to PreviousEncryptionKeys,
+	// the file is re-encrypted on the next start. BackendSQLite refuses to open with a key.
+	EncryptionKey          string
+	PreviousEncryptionKeys []string
+
+	// BackupDir holds timestamped backups, "backups" if empty
+	BackupDir string
+	// BackupRetain is how many backups to keep, 0 keeps them all
+	BackupRetain int
+	// AdminKey guards the /admin backup endpoints, they are disabled while it is empty
+	AdminKey string
+
+	// Blobs stores uploaded media, a directory of files under MediaDir if nil
+	Blobs BlobStore
+	// MediaDir holds uploaded media when Blobs is nil, "media" if empty
+	MediaDir string
+
+	// ContentFilter masks, rejects or flags chirp bodies, api.DefaultContentFilter if nil
+	ContentFilter *api.ContentFilter
+
+	// SweepInterval is how often RunSweeper purges stale data, an hour if zero
+	SweepInterval time.Duration
+	// WebhookRetention is how long webhook events are kept, 30 days if zero
+	WebhookRetention time.Duration
+	// ScheduleInterval is how often RunScheduler looks for due drafts, 10 seconds if zero
+	ScheduleInterval time.Duration
+
+	// TrashRetention is how long deleted chirps can be restored before they are purged, 30 days if zero
+	TrashRetention time.Duration
+
+	// EditWindow is how long after posting a chirp can be edited, 15 minutes if zero.
+	// EditWindowRed replaces it for Chirpy Red users, an hour if zero.
+	EditWindow    time.Duration
+	EditWindowRed time.Duration
+
+	Secret   string
+	PolkaApi string
 }
 
 type RToken struct {
-	UserId   int       `json:"user_id"`
+	UserId   ID        `json:"user_id"`
 	ExpireAt time.Time `json:"expire_at"`
 }
 
 type DBStructure struct {
-	Chirps  map[int]Chirp     `json:"chirps"`
-	Users   map[int]User      `json:"users"`
-	RTokens map[string]RToken `json:"r_tokens"`
+	// SchemaVersion is bumped by every entry in migrations
+	SchemaVersion int `json:"schema_version"`
+
+	Chirps        map[ID]Chirp        `json:"chirps"`
+	Users         map[ID]User         `json:"users"`
+	RTokens       map[string]RToken   `json:"r_tokens"`
+	WebhookEvents map[ID]WebhookEvent `json:"webhook_events"`
+	// Likes and Rechirps are keyed by reactionKey
+	Likes    map[string]Reaction `json:"likes"`
+	Rechirps map[string]Reaction `json:"rechirps"`
+	// Follows is keyed by followKey
+	Follows   map[string]Follow `json:"follows"`
+	Revisions map[ID]Revision   `json:"revisions"`
+	Drafts    map[ID]Draft      `json:"drafts"`
+	// Votes is keyed by reactionKey
+	Votes       map[string]Vote   `json:"votes"`
+	Collections map[ID]Collection `json:"collections"`
+	// Bookmarks is keyed by bookmarkKey
+	Bookmarks map[string]Bookmark `json:"bookmarks"`
+
+	// Sequences holds the last id handed out per bucket
+	Sequences map[string]ID `json:"sequences"`
+
+	// JournalSeq is the last journal entry folded into this snapshot
+	JournalSeq uint64 `json:"journal_seq"`
 }
 
-// loadDB reads the database file into memory
-func (db *DB) loadDB() (DBStructure, error) {
-	db.mux.Lock()
-	defer db.mux.Unlock()
+// newDBStructure returns an empty database with all maps allocated
+func newDBStructure() DBStructure {
+	return DBStructure{
+		SchemaVersion: currentSchemaVersion,
+		Chirps:        make(map[ID]Chirp),
+		Users:         make(map[ID]User),
+		RTokens:       make(map[string]RToken),
+		WebhookEvents: make(map[ID]WebhookEvent),
+		Sequences:     make(map[string]ID),
+		Likes:         make(map[string]Reaction),
+		Rechirps:      make(map[string]Reaction),
+		Follows:       make(map[string]Follow),
+		Revisions:     make(map[ID]Revision),
+		Drafts:        make(map[ID]Draft),
+		Votes:         make(map[string]Vote),
+		Collections:   make(map[ID]Collection),
+		Bookmarks:     make(map[string]Bookmark),
+	}
+}
 
-	dat, err := os.ReadFile(db.path)
-	if err != nil {
-		log.Printf("loadDB readfile error")
-		return DBStructure{}, err
+// validate checks that every record is stored under its own id
+// and that references between records resolve
+func (dbStruct *DBStructure) validate() error {
+	for id, chirp := range dbStruct.Chirps {
+		if chirp.Id != id {
+			return fmt.Errorf("chirp stored under key %v has id %v", id, chirp.Id)
+		}
+		if _, ok := dbStruct.Chirps[chirp.InReplyTo]; chirp.InReplyTo != 0 && !ok {
+			return fmt.Errorf("chirp %v replies to unknown chirp %v", id, chirp.InReplyTo)
+		}
+	}
+	for id, user := range dbStruct.Users {
+		if user.Id != id {
+			return fmt.Errorf("user stored under key %v has id %v", id, user.Id)
+		}
+	}
+	for token, rToken := range dbStruct.RTokens {
+		if _, ok := dbStruct.Users[rToken.UserId]; !ok {
+			return fmt.Errorf("refresh token %q belongs to unknown user %v", token, rToken.UserId)
+		}
+	}
+	for _, reactions := range []map[string]Reaction{dbStruct.Likes, dbStruct.Rechirps} {
+		for key, reaction := range reactions {
+			if key != reactionKey(reaction.ChirpId, reaction.UserId) {
+				return fmt.Errorf("reaction stored under key %q belongs to %v", key, reactionKey(reaction.ChirpId, reaction.UserId))
+			}
+			if _, ok := dbStruct.Chirps[reaction.ChirpId]; !ok {
+				return fmt.Errorf("reaction %q is on unknown chirp %v", key, reaction.ChirpId)
+			}
+			if _, ok := dbStruct.Users[reaction.UserId]; !ok {
+				return fmt.Errorf("reaction %q belongs to unknown user %v", key, reaction.UserId)
+			}
+		}
+	}
+	for key, follow := range dbStruct.Follows {
+		if key != followKey(follow.FollowerId, follow.FolloweeId) {
+			return fmt.Errorf("follow stored under key %q belongs to %v", key, followKey(follow.FollowerId, follow.FolloweeId))
+		}
+		for _, userId := range []ID{follow.FollowerId, follow.FolloweeId} {
+			if _, ok := dbStruct.Users[userId]; !ok {
+				return fmt.Errorf("follow %q refers to unknown user %v", key, userId)
+			}
+		}
 	}
+	for id, revision := range dbStruct.Revisions {
+		if revision.Id != id {
+			return fmt.Errorf("revision stored under key %v has id %v", id, revision.Id)
+		}
+		if _, ok := dbStruct.Chirps[revision.ChirpId]; !ok {
+			return fmt.Errorf("revision %v is of unknown chirp %v", id, revision.ChirpId)
+		}
+	}
+	for id, draft := range dbStruct.Drafts {
+		if draft.Id != id {
+			return fmt.Errorf("draft stored under key %v has id %v", id, draft.Id)
+		}
+		if _, ok := dbStruct.Users[draft.AuthorId]; !ok {
+			return fmt.Errorf("draft %v belongs to unknown user %v", id, draft.AuthorId)
+		}
+	}
+	for key, vote := range dbStruct.Votes {
+		if key != reactionKey(vote.ChirpId, vote.UserId) {
+			return fmt.Errorf("vote stored under key %q belongs to %v", key, reactionKey(vote.ChirpId, vote.UserId))
+		}
+		if chirp, ok := dbStruct.Chirps[vote.ChirpId]; !ok || chirp.Poll == nil {
+			return fmt.Errorf("vote %q is on unknown poll %v", key, vote.ChirpId)
+		}
+		if _, ok := dbStruct.Users[vote.UserId]; !ok {
+			return fmt.Errorf("vote %q belongs to unknown user %v", key, vote.UserId)
+		}
+	}
+	for id, collection := range dbStruct.Collections {
+		if collection.Id != id {
+			return fmt.Errorf("collection stored under key %v has id %v", id, collection.Id)
+		}
+		if _, ok := dbStruct.Users[collection.OwnerId]; !ok {
+			return fmt.Errorf("collection %v belongs to unknown user %v", id, collection.OwnerId)
+		}
+	}
+	// bookmarks may point at chirps that have since been purged
+	for key, bookmark := range dbStruct.Bookmarks {
+		if key != bookmarkKey(bookmark.UserId, bookmark.CollectionId, bookmark.ChirpId) {
+			return fmt.Errorf("bookmark stored under key %q belongs to %v", key, bookmarkKey(bookmark.UserId, bookmark.CollectionId, bookmark.ChirpId))
+		}
+		if _, ok := dbStruct.Users[bookmark.UserId]; !ok {
+			return fmt.Errorf("bookmark %q belongs to unknown user %v", key, bookmark.UserId)
+		}
+		if collection, ok := dbStruct.Collections[bookmark.CollectionId]; bookmark.CollectionId != 0 && (!ok || collection.OwnerId != bookmark.UserId) {
+			return fmt.Errorf("bookmark %q is in unknown collection %v", key, bookmark.CollectionId)
+		}
+	}
+	return nil
+}
 
+// decodeDB parses the contents of a database file, an empty file is an empty database
+func decodeDB(dat []byte) (DBStructure, error) {
+	result := newDBStructure()
 	if len(dat) == 0 {
-		return DBStructure{
-			Chirps:  make(map[int]Chirp),
-			Users:   make(map[int]User),
-			RTokens: make(map[string]RToken),
-		}, nil
+		return result, nil
 	}
 
-	var result DBStructure
-	err = json.Unmarshal(dat, &result)
+	err := json.Unmarshal(dat, &result)
 	if err != nil {
 		log.Printf("loadDB UnMarshall error")
 		return DBStructure{}, err
 	}
 
+	// files written by older versions may be missing a map entirely
+	if result.Chirps == nil {
+		result.Chirps = make(map[ID]Chirp)
+	}
+	if result.Users == nil {
+		result.Users = make(map[ID]User)
+	}
+	if result.RTokens == nil {
+		result.RTokens = make(map[string]RToken)
+	}
+	if result.WebhookEvents == nil {
+		result.WebhookEvents = make(map[ID]WebhookEvent)
+	}
+	if result.Sequences == nil {
+		result.Sequences = make(map[string]ID)
+	}
+	if result.Likes == nil {
+		result.Likes = make(map[string]Reaction)
+	}
+	if result.Rechirps == nil {
+		result.Rechirps = make(map[string]Reaction)
+	}
+	if result.Follows == nil {
+		result.Follows = make(map[string]Follow)
+	}
+	if result.Revisions == nil {
+		result.Revisions = make(map[ID]Revision)
+	}
+	if result.Drafts == nil {
+		result.Drafts = make(map[ID]Draft)
+	}
+	if result.Votes == nil {
+		result.Votes = make(map[string]Vote)
+	}
+	if result.Collections == nil {
+		result.Collections = make(map[ID]Collection)
+	}
+	if result.Bookmarks == nil {
+		result.Bookmarks = make(map[string]Bookmark)
+	}
+
 	return result, nil
 }
 
-// writeDB writes the database file to disk
-func (db *DB) writeDB(dbStructure DBStructure) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
-	dat, err := json.Marshal(dbStructure)
+// NewDB opens the backend selected in cfg and checks that it holds a valid DBStructure
+func NewDB(cfg Config) (*DB, error) {
+	store, err := OpenStore(cfg)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return NewDBWithStore(store, cfg)
+}
+
+// NewDBWithStore creates a database connection on top of an already open store,
+// cfg.Backend, cfg.Path and cfg.Reset are ignored
+func NewDBWithStore(store Store, cfg Config) (*DB, error) {
+	db := &DB{
+		store:        store,
+		mux:          &sync.RWMutex{},
+		secret:       cfg.Secret,
+		polkaApi:     cfg.PolkaApi,
+		idMode:       cfg.IDMode,
+		backupDir:    cfg.BackupDir,
+		backupRetain: cfg.BackupRetain,
+		adminKey:     cfg.AdminKey,
+		blobs:        cfg.Blobs,
+		filter:       cfg.ContentFilter,
 
-	err = os.WriteFile(db.path, []byte(dat), 0666)
+		sweepInterval:    cfg.SweepInterval,
+		webhookRetention: cfg.WebhookRetention,
+		scheduleInterval: cfg.ScheduleInterval,
+
+		editWindow:     cfg.EditWindow,
+		editWindowRed:  cfg.EditWindowRed,
+		trashRetention: cfg.TrashRetention,
+	}
+	if db.backupDir == "" {
+		db.backupDir = "backups"
+	}
+	if db.blobs == nil {
+		mediaDir := cfg.MediaDir
+		if mediaDir == "" {
+			mediaDir = "media"
+		}
+		blobs, err := newFileBlobStore(mediaDir)
+		if err != nil {
+			return nil, err
+		}
+		db.blobs = blobs
+	}
+	if db.filter == nil {
+		db.filter = api.DefaultContentFilter()
+	}
+	if db.sweepInterval <= 0 {
+		db.sweepInterval = time.Hour
+	}
+	if db.webhookRetention <= 0 {
+		db.webhookRetention = 30 * 24 * time.Hour
+	}
+	if db.scheduleInterval <= 0 {
+		db.scheduleInterval = 10 * time.Second
+	}
+	if db.editWindow <= 0 {
+		db.editWindow = 15 * time.Minute
+	}
+	if db.editWindowRed <= 0 {
+		db.editWindowRed = time.Hour
+	}
+	if db.trashRetention <= 0 {
+		db.trashRetention = 30 * 24 * time.Hour
+	}
+	keys, err := newKeyring(cfg.EncryptionKey, cfg.PreviousEncryptionKeys)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	db.keys = keys
 
-	return nil
-}
+	switch cfg.IDMode {
+	case "", IDSequence:
+		db.idMode = IDSequence
+	case IDSnowflake:
+	default:
+		return nil, fmt.Errorf("unknown id mode %q", cfg.IDMode)
+	}
+
+	err = db.reload()
+	if err != nil {
+		return nil, fmt.Errorf("NewDB load: %w", err)
+	}
 
-// NewDB creates a new database connection
-// and creates the database file if it doesn't exist
-func NewDB(fpath, secret, polkaApi string) (*DB, error) {
-	db := &DB{path: fpath, mux: &sync.RWMutex{}, secret: secret, polkaApi: polkaApi}
-	db.ensureDB()
+	err = db.View(func(tx *Tx) error {
+		err := tx.data.validate()
+		if err != nil {
+			return fmt.Errorf("NewDB invalid database: %w", err)
+		}
+		log.Printf("NewDB: %d users, %d chirps", len(tx.data.Users), len(tx.data.Chirps))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 	return db, nil
 }
 
-// ensureDB creates a new database file if it doesn't exist
-func (db *DB) ensureDB() error {
+// Close flushes and releases the store
+func (db *DB) Close() error {
 	db.mux.Lock()
 	defer db.mux.Unlock()
-
-	os.Remove(db.path)
-	os.Create(db.path)
-	return nil
+	return db.store.Close()
 }
@@ -0,0 +1,369 @@
+package cDatabase
+
+import (
+	"errors"
+	"internal/api"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Draft is a chirp that hasn't been posted yet. Setting PublishAt schedules it,
+// RunScheduler publishes it once that time has passed. If publishing fails the
+// draft is unscheduled again and Error says why.
+type Draft struct {
+	Id        ID         `json:"id"`
+	AuthorId  ID         `json:"author_id"`
+	Body      string     `json:"body"`
+	InReplyTo ID         `json:"in_reply_to,omitempty"`
+	PublishAt *time.Time `json:"publish_at,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// NewDraft is what a client supplies to save or replace a draft,
+// PublishAt is nil for a plain draft
+type NewDraft struct {
+	Body      string
+	AuthorId  ID
+	InReplyTo ID
+	PublishAt *time.Time
+}
+
+type draftRequest struct {
+	Body      string     `json:"body"`
+	InReplyTo ID         `json:"in_reply_to"`
+	PublishAt *time.Time `json:"publish_at"`
+}
+
+var errPublishAtPast = errors.New("publish_at must be in the future")
+
+// check validates d against the current data
+func (d NewDraft) check(tx *Tx) error {
+	if strings.TrimSpace(d.Body) == "" {
+		return errEmptyBody
+	}
+	if d.PublishAt != nil && !d.PublishAt.After(time.Now()) {
+		return errPublishAtPast
+	}
+	// masking waits until the draft is published, under the rules in force then
+	_, _, err := tx.checkBody(tx.rewriteMentions(d.Body))
+	if err != nil {
+		return err
+	}
+	return tx.checkReply(d.InReplyTo)
+}
+
+// CreateDraft saves a new draft, scheduled if d.PublishAt is set
+func (db *DB) CreateDraft(d NewDraft) (Draft, error) {
+	var result Draft
+	err := db.Update(func(tx *Tx) error {
+		err := d.check(tx)
+		if err != nil {
+			return err
+		}
+		id, err := tx.nextID(bucketDrafts)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		result = Draft{Id: id, AuthorId: d.AuthorId, Body: d.Body, InReplyTo: d.InReplyTo, PublishAt: d.PublishAt, CreatedAt: now, UpdatedAt: now}
+		return tx.put(bucketDrafts, id.String(), result)
+	})
+	return result, err
+}
+
+// UpdateDraft replaces the body, parent and schedule of one of d.AuthorId's drafts
+func (db *DB) UpdateDraft(draftId ID, d NewDraft) (Draft, error) {
+	var result Draft
+	err := db.Update(func(tx *Tx) error {
+		draft, err := tx.ownDraft(draftId, d.AuthorId)
+		if err != nil {
+			return err
+		}
+		err = d.check(tx)
+		if err != nil {
+			return err
+		}
+		draft.Body = d.Body
+		draft.InReplyTo = d.InReplyTo
+		draft.PublishAt = d.PublishAt
+		draft.Error = ""
+		draft.UpdatedAt = time.Now().UTC()
+		result = draft
+		return tx.put(bucketDrafts, draft.Id.String(), draft)
+	})
+	return result, err
+}
+
+// DeleteDraft discards a draft, cancelling it if it was scheduled
+func (db *DB) DeleteDraft(draftId, userId ID) error {
+	return db.Update(func(tx *Tx) error {
+		_, err := tx.ownDraft(draftId, userId)
+		if err != nil {
+			return err
+		}
+		return tx.del(bucketDrafts, draftId.String())
+	})
+}
+
+// GetDrafts returns userId's drafts by ascending id, only the scheduled ones if scheduled is set
+func (db *DB) GetDrafts(userId ID, scheduled bool) ([]Draft, error) {
+	result := []Draft{}
+	err := db.View(func(tx *Tx) error {
+		for _, id := range tx.data.draftsByAuthor[userId] {
+			draft := tx.data.Drafts[id]
+			if scheduled && draft.PublishAt == nil {
+				continue
+			}
+			result = append(result, draft)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// GetDraft returns one of userId's drafts
+func (db *DB) GetDraft(draftId, userId ID) (Draft, error) {
+	var result Draft
+	err := db.View(func(tx *Tx) error {
+		var err error
+		result, err = tx.ownDraft(draftId, userId)
+		return err
+	})
+	return result, err
+}
+
+// PublishDraft posts one of userId's drafts right away, scheduled or not,
+// and returns the chirp as its author sees it
+func (db *DB) PublishDraft(draftId, userId ID) (ChirpResponse, error) {
+	var result ChirpResponse
+	err := db.Update(func(tx *Tx) error {
+		draft, err := tx.ownDraft(draftId, userId)
+		if err != nil {
+			return err
+		}
+		chirp, err := tx.publishDraft(draft)
+		if err != nil {
+			return err
+		}
+		result = tx.chirpResponse(chirp, userId)
+		return nil
+	})
+	return result, err
+}
+
+// ownDraft returns a draft of userId's, drafts are private so anyone else's is not found
+func (tx *Tx) ownDraft(draftId, userId ID) (Draft, error) {
+	draft, ok := tx.data.Drafts[draftId]
+	if !ok || draft.AuthorId != userId {
+		return Draft{}, ErrNotFound
+	}
+	return draft, nil
+}
+
+// publishDraft turns draft into a chirp through the same path as POST /api/chirps
+func (tx *Tx) publishDraft(draft Draft) (Chirp, error) {
+	chirp, err := tx.createChirp(NewChirp{Body: draft.Body, AuthorId: draft.AuthorId, InReplyTo: draft.InReplyTo})
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, tx.del(bucketDrafts, draft.Id.String())
+}
+
+// { H{"Authorization: Bearer ${jwtToken}"}, {body, in_reply_to, publish_at} } -> Draft
+func (db *DB) HandlePostDraft(w http.ResponseWriter, r *http.Request) {
+	userId, err := db.authenticate(r)
+	if err != nil {
+		log.Print("PostDraft, authenticate:", err.Error())
+		w.WriteHeader(401)
+		return
+	}
+
+	var request draftRequest
+	err = api.RecieveJson(w, r, &request)
+	if err != nil {
+		log.Print("PostDraft, RecieveJson:", err.Error())
+		w.WriteHeader(400)
+		return
+	}
+
+	draft, err := db.CreateDraft(NewDraft{Body: request.Body, AuthorId: userId, InReplyTo: request.InReplyTo, PublishAt: request.PublishAt})
+	if errors.Is(err, errEmptyBody) || errors.Is(err, errPublishAtPast) || errors.Is(err, errBadReply) || errors.Is(err, errChirpTooLong) || errors.Is(err, errBlockedContent) {
+		db.sendJson(w, r, api.JsonErr{ErrorMsg: err.Error()}, 400)
+		return
+	}
+	if err != nil {
+		log.Print("PostDraft, CreateDraft:", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	err = db.sendJson(w, r, draft, 201)
+	if err != nil {
+		log.Print("PostDraft, SendJson:", err.Error())
+	}
+}
+
+// { H{"Authorization: Bearer ${jwtToken}"}, {body, in_reply_to, publish_at} } -> Draft
+func (db *DB) HandlePutDraft(w http.ResponseWriter, r *http.Request) {
+	userId, err := db.authenticate(r)
+	if err != nil {
+		log.Print("PutDraft, authenticate:", err.Error())
+		w.WriteHeader(401)
+		return
+	}
+
+	draftId, err := ParseID(r.PathValue("draftId"))
+	if err != nil {
+		log.Print("PutDraft, ParseID:", err.Error())
+		w.WriteHeader(400)
+		return
+	}
+
+	var request draftRequest
+	err = api.RecieveJson(w, r, &request)
+	if err != nil {
+		log.Print("PutDraft, RecieveJson:", err.Error())
+		w.WriteHeader(400)
+		return
+	}
+
+	draft, err := db.UpdateDraft(draftId, NewDraft{Body: request.Body, AuthorId: userId, InReplyTo: request.InReplyTo, PublishAt: request.PublishAt})
+	if errors.Is(err, ErrNotFound) {
+		w.WriteHeader(404)
+		return
+	}
+	if errors.Is(err, errEmptyBody) || errors.Is(err, errPublishAtPast) || errors.Is(err, errBadReply) || errors.Is(err, errChirpTooLong) || errors.Is(err, errBlockedContent) {
+		db.sendJson(w, r, api.JsonErr{ErrorMsg: err.Error()}, 400)
+		return
+	}
+	if err != nil {
+		log.Print("PutDraft, UpdateDraft:", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	err = db.sendJson(w, r, draft, 200)
+	if err != nil {
+		log.Print("PutDraft, SendJson:", err.Error())
+	}
+}
+
+// DELETE /api/drafts/{draftId}
+func (db *DB) HandleDeleteDraft(w http.ResponseWriter, r *http.Request) {
+	userId, err := db.authenticate(r)
+	if err != nil {
+		log.Print("DeleteDraft, authenticate:", err.Error())
+		w.WriteHeader(401)
+		return
+	}
+
+	draftId, err := ParseID(r.PathValue("draftId"))
+	if err != nil {
+		log.Print("DeleteDraft, ParseID:", err.Error())
+		w.WriteHeader(400)
+		return
+	}
+
+	err = db.DeleteDraft(draftId, userId)
+	if errors.Is(err, ErrNotFound) {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		log.Print("DeleteDraft:", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// GET /api/drafts?scheduled=true -> []Draft
+func (db *DB) HandleGetDrafts(w http.ResponseWriter, r *http.Request) {
+	userId, err := db.authenticate(r)
+	if err != nil {
+		log.Print("GetDrafts, authenticate:", err.Error())
+		w.WriteHeader(401)
+		return
+	}
+
+	drafts, err := db.GetDrafts(userId, r.URL.Query().Get("scheduled") == "true")
+	if err != nil {
+		log.Print("GetDrafts:", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	err = db.sendJson(w, r, drafts, 200)
+	if err != nil {
+		log.Print("GetDrafts, SendJson:", err.Error())
+	}
+}
+
+// GET /api/drafts/{draftId} -> Draft
+func (db *DB) HandleGetDraft(w http.ResponseWriter, r *http.Request) {
+	userId, err := db.authenticate(r)
+	if err != nil {
+		log.Print("GetDraft, authenticate:", err.Error())
+		w.WriteHeader(401)
+		return
+	}
+
+	draftId, err := ParseID(r.PathValue("draftId"))
+	if err != nil {
+		log.Print("GetDraft, ParseID:", err.Error())
+		w.WriteHeader(400)
+		return
+	}
+
+	draft, err := db.GetDraft(draftId, userId)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	err = db.sendJson(w, r, draft, 200)
+	if err != nil {
+		log.Print("GetDraft, SendJson:", err.Error())
+	}
+}
+
+// POST /api/drafts/{draftId}/publish -> ChirpResponse
+func (db *DB) HandlePostPublishDraft(w http.ResponseWriter, r *http.Request) {
+	userId, err := db.authenticate(r)
+	if err != nil {
+		log.Print("PublishDraft, authenticate:", err.Error())
+		w.WriteHeader(401)
+		return
+	}
+
+	draftId, err := ParseID(r.PathValue("draftId"))
+	if err != nil {
+		log.Print("PublishDraft, ParseID:", err.Error())
+		w.WriteHeader(400)
+		return
+	}
+
+	chirp, err := db.PublishDraft(draftId, userId)
+	if errors.Is(err, ErrNotFound) {
+		w.WriteHeader(404)
+		return
+	}
+	if errors.Is(err, errBadReply) || errors.Is(err, errChirpTooLong) || errors.Is(err, errBlockedContent) {
+		db.sendJson(w, r, api.JsonErr{ErrorMsg: err.Error()}, 400)
+		return
+	}
+	if err != nil {
+		log.Print("PublishDraft:", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	err = db.sendJson(w, r, chirp, 201)
+	if err != nil {
+		log.Print("PublishDraft, SendJson:", err.Error())
+	}
+}
@@ -0,0 +1,452 @@
+package cDatabase
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// compactEvery is how many journal entries (committed batches) are kept before they are
+// folded into database.json and the journal is truncated
+const compactEvery = 1000
+
+// fileStore keeps the dataset in a single JSON file
+// plus an append-only journal of changes since the last compaction
+type fileStore struct {
+	path string
+	mux  sync.Mutex
+	// keys encrypts the file and journal, nil stores plaintext
+	keys *keyring
+
+	// journal is the open write-ahead log, seq the last sequence number
+	// written to it and pending the number of entries since the last compaction
+	journal *os.File
+	seq     uint64
+	pending int
+}
+
+// openFileStore opens the database file at path and creates it if it doesn't exist.
+// If reset is true an existing database file is wiped first, meant for dev only
+func openFileStore(path string, reset bool, keys *keyring) (*fileStore, error) {
+	fs := &fileStore{path: path, keys: keys}
+
+	if reset {
+		err := fs.reset()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := fs.ensure()
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// ensure creates a new database file if it doesn't exist,
+// an existing file must hold a valid DBStructure
+func (fs *fileStore) ensure() error {
+	_, err := os.Stat(fs.path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("ensureDB: %s not found, creating empty database", fs.path)
+		err = fs.writeSnapshot(newDBStructure())
+		if err != nil {
+			return fmt.Errorf("ensureDB create %s: %w", fs.path, err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("ensureDB stat %s: %w", fs.path, err)
+	}
+
+	dbStruct, err := fs.Load()
+	if err != nil {
+		return fmt.Errorf("ensureDB %s is not a valid database: %w", fs.path, err)
+	}
+
+	// the snapshot below also re-encrypts a plaintext file or one sealed with a previous key
+	dat, err := os.ReadFile(fs.path)
+	if err != nil {
+		return err
+	}
+	if !fs.keys.isCurrent(dat) {
+		log.Printf("ensureDB: re-encrypting %s with the current key", fs.path)
+	}
+
+	// pick up numbering where the snapshot and journal left off,
+	// then fold any replayed entries and migrations into a fresh snapshot
+	entries, err := fs.readJournal()
+	if err != nil {
+		return err
+	}
+	fs.seq = dbStruct.JournalSeq
+	if len(entries) > 0 && entries[len(entries)-1].Seq > fs.seq {
+		fs.seq = entries[len(entries)-1].Seq
+	}
+	err = fs.Snapshot(dbStruct)
+	if err != nil {
+		return fmt.Errorf("ensureDB compact: %w", err)
+	}
+
+	log.Printf("ensureDB: loaded %s (%d journal entries replayed)", fs.path, len(entries))
+	return nil
+}
+
+// reset removes the database file and its journal
+func (fs *fileStore) reset() error {
+	log.Printf("resetDB: removing %s", fs.path)
+	for _, path := range []string{fs.path, fs.journalPath()} {
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load reads the database file and replays the journal on top of it
+func (fs *fileStore) Load() (DBStructure, error) {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	return fs.read()
+}
+
+// read is Load for callers already holding fs.mux
+func (fs *fileStore) read() (DBStructure, error) {
+	dat, err := os.ReadFile(fs.path)
+	if err != nil {
+		log.Printf("loadDB readfile error")
+		return DBStructure{}, err
+	}
+	dat, err = fs.keys.open(dat)
+	if err != nil {
+		return DBStructure{}, err
+	}
+
+	entries, err := fs.readJournal()
+	if err != nil {
+		log.Printf("loadDB readJournal error")
+		return DBStructure{}, err
+	}
+	// the journal holds records in the snapshot's schema,
+	// an outdated snapshot takes its journal along through the migrations
+	dat, err = replayOutdated(dat, entries)
+	if err != nil {
+		return DBStructure{}, err
+	}
+
+	dat, reports, err := migrateDocument(dat)
+	if err != nil {
+		return DBStructure{}, err
+	}
+	for _, report := range reports {
+		log.Printf("loadDB: migrated %s v%d -> v%d: %s %v", fs.path, report.From, report.To, report.Description, report.Changes)
+	}
+
+	result, err := decodeDB(dat)
+	if err != nil {
+		return DBStructure{}, err
+	}
+
+	for _, entry := range entries {
+		if entry.Seq <= result.JournalSeq {
+			continue
+		}
+		for _, c := range entry.Changes {
+			err = result.apply(c)
+			if err != nil {
+				return DBStructure{}, err
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// replayOutdated applies the journal entries past the snapshot in dat to the raw document
+// if its schema is older than currentSchemaVersion, so the migrations see them too.
+// A current document is returned as it is and the journal is replayed after decoding.
+func replayOutdated(dat []byte, entries []journalEntry) ([]byte, error) {
+	if len(dat) == 0 || len(entries) == 0 {
+		return dat, nil
+	}
+	var header struct {
+		SchemaVersion int    `json:"schema_version"`
+		JournalSeq    uint64 `json:"journal_seq"`
+	}
+	err := json.Unmarshal(dat, &header)
+	if err != nil {
+		return nil, err
+	}
+	if header.SchemaVersion >= currentSchemaVersion {
+		return dat, nil
+	}
+
+	doc, err := decodeDocument(dat)
+	if err != nil {
+		return nil, err
+	}
+	seq := header.JournalSeq
+	for _, entry := range entries {
+		if entry.Seq <= seq {
+			continue
+		}
+		for _, c := range entry.Changes {
+			records, ok := doc[c.Bucket].(map[string]interface{})
+			if !ok {
+				records = map[string]interface{}{}
+				doc[c.Bucket] = records
+			}
+			switch c.Op {
+			case opPut:
+				dec := json.NewDecoder(bytes.NewReader(c.Value))
+				dec.UseNumber()
+				var v interface{}
+				err = dec.Decode(&v)
+				if err != nil {
+					return nil, fmt.Errorf("replay %s key %q: %w", c.Bucket, c.Key, err)
+				}
+				records[c.Key] = v
+			case opDelete:
+				delete(records, c.Key)
+			default:
+				return nil, fmt.Errorf("replay: unknown op %q", c.Op)
+			}
+		}
+		seq = entry.Seq
+	}
+	doc["journal_seq"] = seq
+	return json.Marshal(doc)
+}
+
+// Commit appends changes to the journal, compacting it once it grows past compactEvery
+func (fs *fileStore) Commit(changes []change) error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	err := fs.appendJournal(changes)
+	if err != nil {
+		return err
+	}
+
+	if fs.pending >= compactEvery {
+		err = fs.compact()
+		if err != nil {
+			log.Print("commit, compact:", err.Error())
+		}
+	}
+	return nil
+}
+
+// Snapshot replaces the database file with dbStruct and empties the journal
+func (fs *fileStore) Snapshot(dbStruct DBStructure) error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	return fs.replace(dbStruct)
+}
+
+// Compact folds the journal into the database file
+func (fs *fileStore) Compact() error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	return fs.compact()
+}
+
+// Close compacts the journal and closes it
+func (fs *fileStore) Close() error {
+	return fs.Compact()
+}
+
+// compact writes a fresh snapshot and truncates the journal,
+// the caller must hold fs.mux
+func (fs *fileStore) compact() error {
+	dbStruct, err := fs.read()
+	if err != nil {
+		return err
+	}
+	return fs.replace(dbStruct)
+}
+
+// replace writes dbStruct as the new snapshot and truncates the journal,
+// the caller must hold fs.mux
+func (fs *fileStore) replace(dbStruct DBStructure) error {
+	dbStruct.JournalSeq = fs.seq
+	err := fs.writeSnapshot(dbStruct)
+	if err != nil {
+		return err
+	}
+
+	if fs.journal != nil {
+		fs.journal.Close()
+		fs.journal = nil
+	}
+	err = os.Truncate(fs.journalPath(), 0)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	fs.pending = 0
+	return nil
+}
+
+// writeSnapshot atomically replaces the database file with dbStruct,
+// readable by the owner only since it holds password hashes and refresh tokens
+func (fs *fileStore) writeSnapshot(dbStruct DBStructure) error {
+	dat, err := json.Marshal(dbStruct)
+	if err != nil {
+		return err
+	}
+	dat, err = fs.keys.seal(dat)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(fs.path, dat, 0600)
+}
+
+// journalPath is the write-ahead log that lives next to the database file
+func (fs *fileStore) journalPath() string {
+	return fs.path + ".wal"
+}
+
+// journalEntry is one line of the journal, a batch of changes committed together
+type journalEntry struct {
+	Seq     uint64   `json:"seq"`
+	Changes []change `json:"changes"`
+}
+
+// readJournal returns every complete entry in the journal.
+// A torn last line from a crash mid-append is dropped, along with its whole batch.
+func (fs *fileStore) readJournal() ([]journalEntry, error) {
+	dat, err := os.ReadFile(fs.journalPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	lines := bytes.Split(dat, []byte("\n"))
+	// every complete entry ends in a newline, anything after the last one was torn
+	if torn := lines[len(lines)-1]; len(torn) > 0 {
+		log.Printf("readJournal: dropping torn entry of %d bytes", len(torn))
+	}
+	lines = lines[:len(lines)-1]
+
+	result := make([]journalEntry, 0, len(lines))
+	for i, line := range lines {
+		var entry journalEntry
+		line, err = fs.keys.openLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("journal line %d: %w", i+1, err)
+		}
+		err = json.Unmarshal(line, &entry)
+		if err != nil {
+			return nil, fmt.Errorf("journal line %d: %w", i+1, err)
+		}
+		result = append(result, entry)
+	}
+	return result, nil
+}
+
+// appendJournal writes changes to the journal and syncs it before returning,
+// the caller must hold fs.mux
+func (fs *fileStore) appendJournal(changes []change) error {
+	if fs.journal == nil {
+		f, err := os.OpenFile(fs.journalPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		// tighten journals created by older versions
+		err = f.Chmod(0600)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		fs.journal = f
+	}
+
+	dat, err := json.Marshal(journalEntry{Seq: fs.seq + 1, Changes: changes})
+	if err != nil {
+		return err
+	}
+	dat, err = fs.keys.sealLine(dat)
+	if err != nil {
+		return err
+	}
+	dat = append(dat, '\n')
+
+	// a failed write may leave part of the line behind, cut the journal back
+	// to where it ended so the next entry does not land after a torn one
+	offset, err := fs.journal.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	_, err = fs.journal.Write(dat)
+	if err == nil {
+		err = fs.journal.Sync()
+	}
+	if err != nil {
+		truncErr := fs.journal.Truncate(offset)
+		if truncErr != nil {
+			// the torn line is still last, so compacting reads past it and empties the journal
+			log.Print("appendJournal, Truncate:", truncErr.Error())
+			truncErr = fs.compact()
+			if truncErr != nil {
+				log.Print("appendJournal, compact:", truncErr.Error())
+			}
+		}
+		return err
+	}
+	fs.seq++
+	fs.pending++
+	return nil
+}
+
+// writeFileAtomic writes data to a temp file in the same directory,
+// syncs it and renames it over path so readers never see a partial file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmpName, perm)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpName, path)
+	if err != nil {
+		return err
+	}
+
+	// sync the directory so the rename itself survives a crash
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
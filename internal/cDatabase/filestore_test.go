@@ -0,0 +1,138 @@
+package cDatabase
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestOldJournalMigrated opens a v10 snapshot whose journal still holds v10 records,
+// the journal entries must go through the v11 mention rewrite like the snapshot does
+func TestOldJournalMigrated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	snapshot := `{"schema_version":10,"journal_seq":1,` +
+		`"users":{"1":{"id":1,"email":"a@example.com","created_at":"2024-01-01T00:00:00Z","updated_at":"2024-01-01T00:00:00Z"}},` +
+		`"chirps":{"5":{"id":5,"body":"old @a@example.com","author_id":1,"created_at":"2024-01-01T00:00:00Z","updated_at":"2024-01-01T00:00:00Z"}}}`
+	journal := `{"seq":1,"changes":[{"op":"put","bucket":"chirps","key":"9","value":{"id":9,"body":"already folded","author_id":1}}]}` + "\n" +
+		`{"seq":2,"changes":[{"op":"put","bucket":"users","key":"2","value":{"id":2,"email":"b@example.com","created_at":"2024-01-02T00:00:00Z","updated_at":"2024-01-02T00:00:00Z"}}]}` + "\n" +
+		`{"seq":3,"changes":[{"op":"put","bucket":"chirps","key":"6","value":{"id":6,"body":"hi @a@example.com and @b@example.com","author_id":2,"created_at":"2024-01-03T00:00:00Z","updated_at":"2024-01-03T00:00:00Z"}},` +
+		`{"op":"put","bucket":"chirps","key":"1152921504606846977","value":{"id":1152921504606846977,"body":"flake","author_id":2,"created_at":"2024-01-03T00:00:00Z","updated_at":"2024-01-03T00:00:00Z"}},` +
+		`{"op":"delete","bucket":"chirps","key":"5"}]}` + "\n"
+	err := os.WriteFile(path, []byte(snapshot), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path+".wal", []byte(journal), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err := openFileStore(path, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbStruct, err := fs.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Close()
+
+	if dbStruct.SchemaVersion != currentSchemaVersion {
+		t.Errorf("schema v%d after load, want v%d", dbStruct.SchemaVersion, currentSchemaVersion)
+	}
+	if got := dbStruct.Chirps[6].Body; got != "hi @1 and @2" {
+		t.Errorf("journalled chirp body %q, want %q", got, "hi @1 and @2")
+	}
+	if _, ok := dbStruct.Chirps[9]; ok {
+		t.Error("journal entry already in the snapshot was replayed")
+	}
+	if _, ok := dbStruct.Chirps[5]; ok {
+		t.Error("journalled delete was lost")
+	}
+	if _, ok := dbStruct.Users[2]; !ok {
+		t.Error("journalled user was lost")
+	}
+	const flake = ID(1152921504606846977)
+	if got := dbStruct.Chirps[flake].Id; got != flake {
+		t.Errorf("snowflake chirp id %v after migrating, want %v", got, flake)
+	}
+}
+
+// TestTornJournal cuts the journal inside its last entry, as a crash mid-write would,
+// and checks each copy opens with the complete entries and keeps taking commits
+func TestTornJournal(t *testing.T) {
+	for _, key := range []string{"", testKey(4)} {
+		keys, err := newKeyring(key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), "database.json")
+		fs, err := openFileStore(path, false, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		commitUser := func(fs *fileStore, id ID) {
+			t.Helper()
+			c, err := putChange(bucketUsers, id.String(), User{Id: id, Email: fmt.Sprintf("user%d@example.com", id)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = fs.Commit([]change{c})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for id := ID(1); id <= 3; id++ {
+			commitUser(fs, id)
+		}
+		snapshot, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		journal, err := os.ReadFile(path + ".wal")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs.journal.Close()
+
+		lastStart := bytes.LastIndexByte(journal[:len(journal)-1], '\n') + 1
+		lastLen := len(journal) - lastStart
+		for _, cut := range []int{lastStart, lastStart + 1, lastStart + lastLen/2, len(journal) - 2, len(journal) - 1} {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "database.json")
+			err = os.WriteFile(path, snapshot, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.WriteFile(path+".wal", journal[:cut], 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fs, err := openFileStore(path, false, keys)
+			if err != nil {
+				t.Fatalf("key %v, cut at %d: %v", key != "", cut, err)
+			}
+			commitUser(fs, 4)
+			fs.journal.Close()
+
+			// reopen from the journal alone, without the compaction Close does
+			fs, err = openFileStore(path, false, keys)
+			if err != nil {
+				t.Fatalf("key %v, cut at %d, reopen: %v", key != "", cut, err)
+			}
+			dbStruct, err := fs.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			fs.Close()
+			for id, want := range map[ID]bool{1: true, 2: true, 3: false, 4: true} {
+				if _, ok := dbStruct.Users[id]; ok != want {
+					t.Errorf("key %v, cut at %d: user %v present = %v, want %v", key != "", cut, id, ok, want)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package cDatabase
+
+import (
+	"container/heap"
+	"errors"
+	"internal/api"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Follow is FollowerId subscribing to FolloweeId's chirps
+type Follow struct {
+	FollowerId ID        `json:"follower_id"`
+	FolloweeId ID        `json:"followee_id"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+var errFollowSelf = errors.New("users can't follow themselves")
+
+// followKey is the key of a follow in the follows bucket, one per pair of users
+func followKey(followerId, followeeId ID) string {
+	return followerId.String() + ":" + followeeId.String()
+}
+
+// SetFollow makes followerId follow (on) or unfollow followeeId,
+// repeating either is a no-op
+func (db *DB) SetFollow(followerId, followeeId ID, on bool) error {
+	if followerId == followeeId {
+		return errFollowSelf
+	}
+	return db.Update(func(tx *Tx) error {
+		if _, ok := tx.data.Users[followeeId]; !ok {
+			return ErrNotFound
+		}
+		if _, ok := tx.data.Users[followerId]; !ok {
+			return ErrForbidden
+		}
+
+		key := followKey(followerId, followeeId)
+		if _, exists := tx.data.Follows[key]; exists == on {
+			return nil
+		}
+		if !on {
+			return tx.del(bucketFollows, key)
+		}
+		return tx.put(bucketFollows, key, Follow{FollowerId: followerId, FolloweeId: followeeId, CreatedAt: time.Now().UTC()})
+	})
+}
+
+// GetFollowers returns the users following userId, or the users userId follows
+// if following is set, by ascending id
+func (db *DB) GetFollowers(userId ID, following bool) ([]PublicUser, error) {
+	result := []PublicUser{}
+	err := db.View(func(tx *Tx) error {
+		if _, ok := tx.data.Users[userId]; !ok {
+			return ErrNotFound
+		}
+		ids := tx.data.followers[userId]
+		if following {
+			ids = tx.data.following[userId]
+		}
+		for _, id := range ids {
+			result = append(result, publicUser(tx.data.Users[id]))
+		}
+		return nil
+	})
+	return result, err
+}
+
+// timelineWalker hands out the chirp ids of userId and everyone they follow in id order,
+// starting after the cursor. It merges each author's already sorted list as it goes,
+// so a page costs about limit·log(authors) rather than a sort of every chirp involved.
+func (tx *Tx) timelineWalker(userId ID, desc bool, after *chirpCursor) func() (ID, bool) {
+	authors := append([]ID{userId}, tx.data.following[userId]...)
+	merge := &idMerge{desc: desc}
+	for _, authorId := range authors {
+		next := idWalker(tx.data.chirpsByAuthor[authorId], desc, after)
+		if id, ok := next(); ok {
+			merge.heads = append(merge.heads, idHead{id: id, next: next})
+		}
+	}
+	heap.Init(merge)
+
+	return func() (ID, bool) {
+		if merge.Len() == 0 {
+			return 0, false
+		}
+		head := &merge.heads[0]
+		id := head.id
+		var ok bool
+		if head.id, ok = head.next(); ok {
+			heap.Fix(merge, 0)
+		} else {
+			heap.Pop(merge)
+		}
+		return id, true
+	}
+}
+
+// idMerge is a heap of id walkers ordered by the id each would hand out next,
+// the smallest on top, or the largest if desc is set
+type idMerge struct {
+	heads []idHead
+	desc  bool
+}
+
+type idHead struct {
+	id   ID
+	next func() (ID, bool)
+}
+
+func (m *idMerge) Len() int { return len(m.heads) }
+func (m *idMerge) Less(i, j int) bool {
+	if m.desc {
+		return m.heads[i].id > m.heads[j].id
+	}
+	return m.heads[i].id < m.heads[j].id
+}
+func (m *idMerge) Swap(i, j int)      { m.heads[i], m.heads[j] = m.heads[j], m.heads[i] }
+func (m *idMerge) Push(x interface{}) { m.heads = append(m.heads, x.(idHead)) }
+func (m *idMerge) Pop() interface{} {
+	last := m.heads[len(m.heads)-1]
+	m.heads = m.heads[:len(m.heads)-1]
+	return last
+}
+
+// POST /api/users/{id}/follow
+func (db *DB) HandlePostFollow(w http.ResponseWriter, r *http.Request) {
+	db.handleFollow(w, r, true)
+}
+
+// DELETE /api/users/{id}/follow
+func (db *DB) HandleDeleteFollow(w http.ResponseWriter, r *http.Request) {
+	db.handleFollow(w, r, false)
+}
+
+func (db *DB) handleFollow(w http.ResponseWriter, r *http.Request, on bool) {
+	userId, err := db.authenticate(r)
+	if err != nil {
+		log.Print("Follow, authenticate:", err.Error())
+		w.WriteHeader(401)
+		return
+	}
+
+	followeeId, err := ParseID(r.PathValue("id"))
+	if err != nil {
+		log.Print("Follow, ParseID:", err.Error())
+		w.WriteHeader(400)
+		return
+	}
+
+	err = db.SetFollow(userId, followeeId, on)
+	if errors.Is(err, errFollowSelf) {
+		db.sendJson(w, r, api.JsonErr{ErrorMsg: err.Error()}, 400)
+		return
+	}
+	if errors.Is(err, ErrNotFound) {
+		w.WriteHeader(404)
+		return
+	}
+	if errors.Is(err, ErrForbidden) {
+		w.WriteHeader(403)
+		return
+	}
+	if err != nil {
+		log.Print("Follow, SetFollow:", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// GET /api/users/{id}/followers -> []PublicUser
+func (db *DB) HandleGetFollowers(w http.ResponseWriter, r *http.Request) {
+	db.handleFollowList(w, r, false)
+}
+
+// GET /api/users/{id}/following -> []PublicUser
+func (db *DB) HandleGetFollowing(w http.ResponseWriter, r *http.Request) {
+	db.handleFollowList(w, r, true)
+}
+
+func (db *DB) handleFollowList(w http.ResponseWriter, r *http.Request, following bool) {
+	userId, err := ParseID(r.PathValue("id"))
+	if err != nil {
+		log.Print("FollowList, ParseID:", err.Error())
+		w.WriteHeader(400)
+		return
+	}
+
+	users, err := db.GetFollowers(userId, following)
+	if errors.Is(err, ErrNotFound) {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		log.Print("FollowList, GetFollowers:", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	err = db.sendJson(w, r, users, 200)
+	if err != nil {
+		log.Print("FollowList, SendJson:", err.Error())
+	}
+}
+
+// GET /api/timeline?limit=&cursor= -> ChirpPage
+//
+// The home timeline holds the chirps of everyone the user follows plus their own,
+// newest first. It is always paged, limit defaults to 20.
+func (db *DB) HandleGetTimeline(w http.ResponseWriter, r *http.Request) {
+	userId, err := db.authenticate(r)
+	if err != nil {
+		log.Print("GetTimeline, authenticate:", err.Error())
+		w.WriteHeader(401)
+		return
+	}
+
+	q, err := parseChirpQuery(r)
+	if err != nil {
+		db.sendJson(w, r, api.JsonErr{ErrorMsg: err.Error()}, 400)
+		return
+	}
+	q.TimelineOf = userId
+	q.SortBy = SortByCreatedAt
+	q.Desc = true
+	if q.Limit == 0 {
+		q.Limit = defaultChirpLimit
+	}
+
+	db.serveChirps(w, r, q)
+}
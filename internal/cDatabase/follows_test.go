@@ -0,0 +1,65 @@
+package cDatabase
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// TestTimelinePaging pages through a timeline both ways and checks it against
+// every chirp by the user and the authors they follow, sorted by id
+func TestTimelinePaging(t *testing.T) {
+	db := newTestDB(t, newMemStore())
+
+	// users 1-4, user 1 follows 2 and 3 but not 4
+	for i := 1; i <= 4; i++ {
+		_, err := db.createUser(fmt.Sprintf("user%d@example.com", i), "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, followee := range []ID{2, 3} {
+		err := db.SetFollow(1, followee, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var want []ID
+	for i := 0; i < 40; i++ {
+		author := ID(i*7%4 + 1)
+		chirp, err := db.CreateChirp(NewChirp{Body: fmt.Sprintf("chirp %d", i), AuthorId: author})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if author != 4 {
+			want = append(want, chirp.Id)
+		}
+	}
+
+	for _, desc := range []bool{false, true} {
+		q := ChirpQuery{TimelineOf: 1, SortBy: SortByCreatedAt, Desc: desc, Limit: 7}
+		var got []ID
+		for {
+			page, err := db.GetChirps(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, chirp := range page.Chirps {
+				got = append(got, chirp.Id)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			q.Cursor = page.NextCursor
+		}
+
+		expected := slices.Clone(want)
+		if desc {
+			slices.Reverse(expected)
+		}
+		if !slices.Equal(got, expected) {
+			t.Errorf("desc=%v: got %v, want %v", desc, got, expected)
+		}
+	}
+}
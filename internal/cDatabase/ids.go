@@ -0,0 +1,92 @@
+package cDatabase
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// ID modes selectable in Config.IDMode
+const (
+	// IDSequence numbers records 1, 2, 3... per bucket
+	IDSequence = "sequence"
+	// IDSnowflake gives new records time-sortable ids. Every id is sent to clients as a
+	// string (see sendJson), too large for JavaScript to hold as a number.
+	// Records created in sequence mode keep their numbers, which sort below every snowflake.
+	IDSnowflake = "snowflake"
+)
+
+// idEpoch is 2024-01-01T00:00:00Z in milliseconds, snowflake ids count from here
+const idEpoch = 1704067200000
+
+// snowflakeShift leaves room for 4M ids per millisecond below the timestamp
+const snowflakeShift = 22
+
+// ID identifies a chirp, user or webhook event.
+// It unmarshals from both JSON numbers and strings and marshals as a number,
+// sendJson turns it into a string for clients of a snowflake DB.
+type ID int64
+
+// ParseID parses a decimal id from a path value, query parameter or JWT subject
+func ParseID(s string) (ID, error) {
+	id, err := strconv.ParseInt(s, 10, 64)
+	return ID(id), err
+}
+
+func (id ID) String() string {
+	return strconv.FormatInt(int64(id), 10)
+}
+
+func (id ID) MarshalJSON() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+func (id *ID) UnmarshalJSON(dat []byte) error {
+	if bytes.HasPrefix(dat, []byte(`"`)) {
+		var s string
+		err := json.Unmarshal(dat, &s)
+		if err != nil {
+			return err
+		}
+		if s == "" {
+			*id = 0
+			return nil
+		}
+		parsed, err := ParseID(s)
+		if err != nil {
+			return err
+		}
+		*id = parsed
+		return nil
+	}
+
+	var n int64
+	err := json.Unmarshal(dat, &n)
+	if err != nil {
+		return err
+	}
+	*id = ID(n)
+	return nil
+}
+
+// nextID hands out the next id for bucket and records the new high-water mark,
+// ids are never reused even after the record they named is deleted
+func (tx *Tx) nextID(bucket string) (ID, error) {
+	last := tx.data.Sequences[bucket]
+
+	id := last + 1
+	if tx.idMode == IDSnowflake {
+		flake := ID((time.Now().UnixMilli() - idEpoch) << snowflakeShift)
+		// a clock step backwards must not hand out an id we already used
+		if flake > id {
+			id = flake
+		}
+	}
+
+	err := tx.put(bucketSequences, bucket, id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
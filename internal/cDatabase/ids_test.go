@@ -0,0 +1,164 @@
+package cDatabase
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestIDEncodingPerDB checks that ids marshal as numbers whatever their size or mode,
+// and that opening a snowflake DB doesn't change how another DB in the same process sends them
+func TestIDEncodingPerDB(t *testing.T) {
+	flakes, err := NewDBWithStore(newMemStore(), Config{IDMode: IDSnowflake, MediaDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := newTestDB(t, newMemStore())
+
+	flake, err := flakes.CreateChirp(NewChirp{Body: "snowflake", AuthorId: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chirp, err := seq.CreateChirp(NewChirp{Body: "sequence", AuthorId: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		id   ID
+		want string
+	}{
+		{chirp.Id, `1`},
+		{flake.Id, flake.Id.String()},
+	} {
+		dat, err := json.Marshal(tc.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(dat) != tc.want {
+			t.Errorf("id %v marshalled as %s, want %s", tc.id, dat, tc.want)
+		}
+		var back ID
+		err = json.Unmarshal(dat, &back)
+		if err != nil || back != tc.id {
+			t.Errorf("id %v round-tripped to %v, %v", tc.id, back, err)
+		}
+		err = json.Unmarshal([]byte(`"`+tc.id.String()+`"`), &back)
+		if err != nil || back != tc.id {
+			t.Errorf("id %v unmarshalled from a string as %v, %v", tc.id, back, err)
+		}
+	}
+}
+
+// TestMixedIDsOnTheWire checks that a response holding both sequence ids and snowflakes
+// uses one JSON type for every id: strings from a snowflake DB, numbers otherwise
+func TestMixedIDsOnTheWire(t *testing.T) {
+	store := newMemStore()
+	seq := newTestDB(t, store)
+	user, err := seq.createUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := seq.CreateChirp(NewChirp{Body: "root", AuthorId: user.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	quote, err := seq.CreateChirp(NewChirp{Body: "quoting", AuthorId: user.Id, QuoteOf: root.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flakes, err := NewDBWithStore(store, Config{IDMode: IDSnowflake, MediaDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := flakes.CreateChirp(NewChirp{Body: "hi @a@example.com", AuthorId: user.Id, InReplyTo: root.Id, QuoteOf: quote.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Id <= 1<<53 {
+		t.Fatalf("reply got id %v, want a snowflake", reply.Id)
+	}
+
+	for _, tc := range []struct {
+		name string
+		db   *DB
+	}{
+		{"snowflake", flakes},
+		{"sequence", newTestDB(t, store)},
+	} {
+		r := httptest.NewRequest("GET", "/api/chirps/1/thread", nil)
+		r.SetPathValue("chirpId", root.Id.String())
+		w := httptest.NewRecorder()
+		tc.db.HandleGetThread(w, r)
+		if w.Code != 200 {
+			t.Fatalf("%s: thread returned %d: %s", tc.name, w.Code, w.Body)
+		}
+
+		if bytes.Contains(w.Body.Bytes(), []byte(`null`)) {
+			t.Errorf("%s: empty fields sent as null: %s", tc.name, w.Body)
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(w.Body.Bytes()))
+		dec.UseNumber()
+		var doc interface{}
+		err = dec.Decode(&doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids := map[string]bool{}
+		walkIDs(doc, "", func(key string, v interface{}) {
+			var s string
+			switch v := v.(type) {
+			case string:
+				if tc.db.idMode != IDSnowflake {
+					t.Errorf("%s: %s is the string %q, want a number", tc.name, key, v)
+				}
+				s = v
+			case json.Number:
+				if tc.db.idMode == IDSnowflake {
+					t.Errorf("%s: %s is the number %v, want a string", tc.name, key, v)
+				}
+				s = v.String()
+			default:
+				t.Errorf("%s: %s is %T", tc.name, key, v)
+			}
+			ids[key+"="+s] = true
+		})
+
+		for _, want := range []string{
+			"id=" + root.Id.String(),
+			"id=" + reply.Id.String(),
+			"author_id=" + user.Id.String(),
+			"in_reply_to=" + root.Id.String(),
+			"quote_of=" + quote.Id.String(),
+			"quote_of=" + root.Id.String(),
+			"mentions=" + user.Id.String(),
+		} {
+			if !ids[want] {
+				t.Errorf("%s: no %s in %s", tc.name, want, w.Body)
+			}
+		}
+	}
+}
+
+// walkIDs calls found with every id in a decoded JSON document
+func walkIDs(doc interface{}, key string, found func(key string, v interface{})) {
+	switch doc := doc.(type) {
+	case map[string]interface{}:
+		for k, v := range doc {
+			walkIDs(v, k, found)
+		}
+	case []interface{}:
+		for _, v := range doc {
+			walkIDs(v, key, found)
+		}
+	default:
+		switch key {
+		case "id", "author_id", "in_reply_to", "quote_of", "mentions":
+			found(key, doc)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package cDatabase
+
+import (
+	"sort"
+	"time"
+)
+
+// state is the in-memory dataset plus the secondary indexes kept in step with it.
+// Refresh tokens need no extra index, RTokens is already keyed by token.
+type state struct {
+	DBStructure
+
+	// usersByEmail maps an email to its user
+	usersByEmail map[string]ID
+	// chirpIds lists every chirp id in ascending order, for paging without a full sort.
+	// Ascending ids are also ascending created_at, see latestChirpAt.
+	chirpIds []ID
+	// latestChirpAt is the newest created_at of any chirp, createChirp never goes below it
+	// so that sorting by created_at is the same as sorting by id
+	latestChirpAt time.Time
+	// chirpsByAuthor lists each author's chirp ids in ascending order
+	chirpsByAuthor map[ID][]ID
+	// chirpsByTag and chirpsByMention list the chirps carrying each tag
+	// and mentioning each user, in ascending order
+	chirpsByTag     map[string][]ID
+	chirpsByMention map[ID][]ID
+	// trashByAuthor lists each author's deleted but not yet purged chirps in ascending order
+	trashByAuthor map[ID][]ID
+	// quotesOf lists the chirps quoting each chirp in ascending order
+	quotesOf map[ID][]ID
+	// repliesTo lists the direct replies to each chirp in ascending order, tombstones included
+	repliesTo map[ID][]ID
+	// search is the full-text index of chirp bodies
+	search searchIndex
+	// likesByChirp and rechirpsByChirp list the users reacting to each chirp,
+	// likesByUser the chirps each user liked, all in ascending order
+	likesByChirp    map[ID][]ID
+	rechirpsByChirp map[ID][]ID
+	likesByUser     map[ID][]ID
+	// revisionsByChirp lists each chirp's revisions, oldest first
+	revisionsByChirp map[ID][]ID
+	// following and followers list the users on each side of each user's follows, ascending
+	following map[ID][]ID
+	followers map[ID][]ID
+	// draftsByAuthor lists each user's drafts in ascending order
+	draftsByAuthor map[ID][]ID
+	// votesByChirp lists the users who voted in each chirp's poll in ascending order
+	votesByChirp map[ID][]ID
+	// collectionsByOwner lists each user's collections in ascending order,
+	// bookmarksByList the chirps saved to each list in ascending order
+	collectionsByOwner map[ID][]ID
+	bookmarksByList    map[bookmarkList][]ID
+	// openPolls lists the chirps whose poll hasn't been closed yet in ascending order
+	openPolls []ID
+	// blobRefs counts the attachments, thumbnails included, pointing at each blob from
+	// chirps live or trashed. releasedBlobs lists blobs whose count dropped to 0 or that
+	// were just written, they are deleted once the Update is over unless a chirp refers to them.
+	blobRefs      map[string]int
+	releasedBlobs []string
+}
+
+// newState takes ownership of dbStruct and builds its indexes
+func newState(dbStruct DBStructure) *state {
+	st := &state{
+		DBStructure:        dbStruct,
+		usersByEmail:       make(map[string]ID, len(dbStruct.Users)),
+		chirpsByAuthor:     make(map[ID][]ID),
+		chirpsByTag:        make(map[string][]ID),
+		chirpsByMention:    make(map[ID][]ID),
+		trashByAuthor:      make(map[ID][]ID),
+		quotesOf:           make(map[ID][]ID),
+		repliesTo:          make(map[ID][]ID),
+		search:             newSearchIndex(),
+		likesByChirp:       make(map[ID][]ID),
+		rechirpsByChirp:    make(map[ID][]ID),
+		likesByUser:        make(map[ID][]ID),
+		revisionsByChirp:   make(map[ID][]ID),
+		following:          make(map[ID][]ID),
+		followers:          make(map[ID][]ID),
+		draftsByAuthor:     make(map[ID][]ID),
+		votesByChirp:       make(map[ID][]ID),
+		collectionsByOwner: make(map[ID][]ID),
+		bookmarksByList:    make(map[bookmarkList][]ID),
+		blobRefs:           make(map[string]int),
+	}
+	for _, user := range dbStruct.Users {
+		st.indexUser(user)
+	}
+	// index chirps in id order so every insert is an append
+	ids := make([]ID, 0, len(dbStruct.Chirps))
+	for id := range dbStruct.Chirps {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		st.indexChirp(dbStruct.Chirps[id])
+	}
+	for key := range dbStruct.Likes {
+		st.index(bucketLikes, key)
+	}
+	for key := range dbStruct.Rechirps {
+		st.index(bucketRechirps, key)
+	}
+	for key := range dbStruct.Follows {
+		st.index(bucketFollows, key)
+	}
+	for id := range dbStruct.Revisions {
+		st.index(bucketRevisions, id.String())
+	}
+	for id := range dbStruct.Drafts {
+		st.index(bucketDrafts, id.String())
+	}
+	for key := range dbStruct.Votes {
+		st.index(bucketVotes, key)
+	}
+	for id := range dbStruct.Collections {
+		st.index(bucketCollections, id.String())
+	}
+	for key := range dbStruct.Bookmarks {
+		st.index(bucketBookmarks, key)
+	}
+	return st
+}
+
+// apply applies c to the dataset and moves the affected index entries
+func (st *state) apply(c change) error {
+	st.unindex(c.Bucket, c.Key)
+	err := st.DBStructure.apply(c)
+	if err != nil {
+		return err
+	}
+	st.index(c.Bucket, c.Key)
+	return nil
+}
+
+func (st *state) index(bucket, key string) {
+	switch bucket {
+	case bucketLikes:
+		if like, ok := st.Likes[key]; ok {
+			addToIndex(st.likesByChirp, like.ChirpId, like.UserId)
+			addToIndex(st.likesByUser, like.UserId, like.ChirpId)
+		}
+		return
+	case bucketRechirps:
+		if rechirp, ok := st.Rechirps[key]; ok {
+			addToIndex(st.rechirpsByChirp, rechirp.ChirpId, rechirp.UserId)
+		}
+		return
+	case bucketFollows:
+		if follow, ok := st.Follows[key]; ok {
+			addToIndex(st.following, follow.FollowerId, follow.FolloweeId)
+			addToIndex(st.followers, follow.FolloweeId, follow.FollowerId)
+		}
+		return
+	case bucketVotes:
+		if vote, ok := st.Votes[key]; ok {
+			addToIndex(st.votesByChirp, vote.ChirpId, vote.UserId)
+		}
+		return
+	case bucketBookmarks:
+		if bookmark, ok := st.Bookmarks[key]; ok {
+			addToIndex(st.bookmarksByList, bookmarkList{bookmark.UserId, bookmark.CollectionId}, bookmark.ChirpId)
+		}
+		return
+	}
+
+	id, err := ParseID(key)
+	if err != nil {
+		return
+	}
+	switch bucket {
+	case bucketUsers:
+		if user, ok := st.Users[id]; ok {
+			st.indexUser(user)
+		}
+	case bucketRevisions:
+		if revision, ok := st.Revisions[id]; ok {
+			addToIndex(st.revisionsByChirp, revision.ChirpId, revision.Id)
+		}
+	case bucketDrafts:
+		if draft, ok := st.Drafts[id]; ok {
+			addToIndex(st.draftsByAuthor, draft.AuthorId, draft.Id)
+		}
+	case bucketCollections:
+		if collection, ok := st.Collections[id]; ok {
+			addToIndex(st.collectionsByOwner, collection.OwnerId, collection.Id)
+		}
+	case bucketChirps:
+		if chirp, ok := st.Chirps[id]; ok {
+			st.indexChirp(chirp)
+		}
+	}
+}
+
+func (st *state) unindex(bucket, key string) {
+	switch bucket {
+	case bucketLikes:
+		if like, ok := st.Likes[key]; ok {
+			dropFromIndex(st.likesByChirp, like.ChirpId, like.UserId)
+			dropFromIndex(st.likesByUser, like.UserId, like.ChirpId)
+		}
+		return
+	case bucketRechirps:
+		if rechirp, ok := st.Rechirps[key]; ok {
+			dropFromIndex(st.rechirpsByChirp, rechirp.ChirpId, rechirp.UserId)
+		}
+		return
+	case bucketFollows:
+		if follow, ok := st.Follows[key]; ok {
+			dropFromIndex(st.following, follow.FollowerId, follow.FolloweeId)
+			dropFromIndex(st.followers, follow.FolloweeId, follow.FollowerId)
+		}
+		return
+	case bucketVotes:
+		if vote, ok := st.Votes[key]; ok {
+			dropFromIndex(st.votesByChirp, vote.ChirpId, vote.UserId)
+		}
+		return
+	case bucketBookmarks:
+		if bookmark, ok := st.Bookmarks[key]; ok {
+			dropFromIndex(st.bookmarksByList, bookmarkList{bookmark.UserId, bookmark.CollectionId}, bookmark.ChirpId)
+		}
+		return
+	}
+
+	id, err := ParseID(key)
+	if err != nil {
+		return
+	}
+	switch bucket {
+	case bucketUsers:
+		if user, ok := st.Users[id]; ok {
+			delete(st.usersByEmail, user.Email)
+		}
+	case bucketRevisions:
+		if revision, ok := st.Revisions[id]; ok {
+			dropFromIndex(st.revisionsByChirp, revision.ChirpId, revision.Id)
+		}
+	case bucketDrafts:
+		if draft, ok := st.Drafts[id]; ok {
+			dropFromIndex(st.draftsByAuthor, draft.AuthorId, draft.Id)
+		}
+	case bucketCollections:
+		if collection, ok := st.Collections[id]; ok {
+			dropFromIndex(st.collectionsByOwner, collection.OwnerId, collection.Id)
+		}
+	case bucketChirps:
+		if chirp, ok := st.Chirps[id]; ok {
+			if chirp.InReplyTo != 0 {
+				dropFromIndex(st.repliesTo, chirp.InReplyTo, chirp.Id)
+			}
+			for _, attachment := range chirp.Attachments {
+				st.releaseBlob(attachment.Hash)
+				st.releaseBlob(attachment.ThumbnailHash)
+			}
+			st.chirpIds = removeID(st.chirpIds, chirp.Id)
+			st.openPolls = removeID(st.openPolls, chirp.Id)
+			if chirp.QuoteOf != 0 {
+				dropFromIndex(st.quotesOf, chirp.QuoteOf, chirp.Id)
+			}
+			dropFromIndex(st.trashByAuthor, chirp.AuthorId, chirp.Id)
+			st.search.remove(chirp)
+			dropFromIndex(st.chirpsByAuthor, chirp.AuthorId, chirp.Id)
+			for _, tag := range chirp.Tags {
+				dropFromIndex(st.chirpsByTag, tag, chirp.Id)
+			}
+			for _, userId := range chirp.Mentions {
+				dropFromIndex(st.chirpsByMention, userId, chirp.Id)
+			}
+		}
+	}
+}
+
+// releaseBlob drops a reference to the blob with the given hash
+func (st *state) releaseBlob(hash string) {
+	st.blobRefs[hash]--
+	if st.blobRefs[hash] <= 0 {
+		delete(st.blobRefs, hash)
+		st.releasedBlobs = append(st.releasedBlobs, hash)
+	}
+}
+
+func (st *state) indexUser(user User) {
+	st.usersByEmail[user.Email] = user.Id
+}
+
+// indexChirp indexes chirp, deleted chirps only keep their place in the reply tree
+// and in their author's trash
+func (st *state) indexChirp(chirp Chirp) {
+	if chirp.CreatedAt.After(st.latestChirpAt) {
+		st.latestChirpAt = chirp.CreatedAt
+	}
+	if chirp.InReplyTo != 0 {
+		addToIndex(st.repliesTo, chirp.InReplyTo, chirp.Id)
+	}
+	for _, attachment := range chirp.Attachments {
+		st.blobRefs[attachment.Hash]++
+		st.blobRefs[attachment.ThumbnailHash]++
+	}
+	if chirp.hidden() {
+		if !chirp.Deleted {
+			addToIndex(st.trashByAuthor, chirp.AuthorId, chirp.Id)
+		}
+		return
+	}
+	st.chirpIds = insertID(st.chirpIds, chirp.Id)
+	if chirp.Poll != nil && !chirp.Poll.Closed {
+		st.openPolls = insertID(st.openPolls, chirp.Id)
+	}
+	if chirp.QuoteOf != 0 {
+		addToIndex(st.quotesOf, chirp.QuoteOf, chirp.Id)
+	}
+	st.search.add(chirp)
+	addToIndex(st.chirpsByAuthor, chirp.AuthorId, chirp.Id)
+	for _, tag := range chirp.Tags {
+		addToIndex(st.chirpsByTag, tag, chirp.Id)
+	}
+	for _, userId := range chirp.Mentions {
+		addToIndex(st.chirpsByMention, userId, chirp.Id)
+	}
+}
+
+// addToIndex adds id to the sorted list under key
+func addToIndex[K comparable](index map[K][]ID, key K, id ID) {
+	index[key] = insertID(index[key], id)
+}
+
+// dropFromIndex removes id from the list under key, and the key once its list is empty
+func dropFromIndex[K comparable](index map[K][]ID, key K, id ID) {
+	ids := removeID(index[key], id)
+	if len(ids) == 0 {
+		delete(index, key)
+	} else {
+		index[key] = ids
+	}
+}
+
+// insertID adds id to the sorted slice ids, new ids usually land at the end
+func insertID(ids []ID, id ID) []ID {
+	i := sort.Search(len(ids), func(i int) bool { return ids[i] >= id })
+	if i < len(ids) && ids[i] == id {
+		return ids
+	}
+	ids = append(ids, 0)
+	copy(ids[i+1:], ids[i:])
+	ids[i] = id
+	return ids
+}
+
+// removeID drops id from the sorted slice ids
+func removeID(ids []ID, id ID) []ID {
+	i := sort.Search(len(ids), func(i int) bool { return ids[i] >= id })
+	if i == len(ids) || ids[i] != id {
+		return ids
+	}
+	return append(ids[:i], ids[i+1:]...)
+}
@@ -0,0 +1,222 @@
+package cDatabase
+
+import (
+	"errors"
+	"internal/api"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Reaction is one user liking or rechirping one chirp
+type Reaction struct {
+	ChirpId   ID        `json:"chirp_id"`
+	UserId    ID        `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// reactionKey is the key of a reaction in the likes and rechirps buckets and of a vote
+// in the votes bucket, one per user and chirp so reacting twice changes nothing
+func reactionKey(chirpId, userId ID) string {
+	return chirpId.String() + ":" + userId.String()
+}
+
+// ChirpResponse is a chirp as seen by the user making the request,
+// the *_by_me fields are false for anonymous requests.
+// Poll replaces the chirp's own poll in JSON so tallies can be hidden,
+// Quoted embeds the chirp named by QuoteOf.
+type ChirpResponse struct {
+	Chirp
+	LikedByMe     bool          `json:"liked_by_me"`
+	RechirpedByMe bool          `json:"rechirped_by_me"`
+	Poll          *PollResponse `json:"poll,omitempty"`
+	Quoted        *QuotedChirp  `json:"quoted,omitempty"`
+}
+
+// chirpResponse renders chirp for viewer, 0 for an anonymous viewer
+func (tx *Tx) chirpResponse(chirp Chirp, viewer ID) ChirpResponse {
+	if chirp.hidden() {
+		return ChirpResponse{Chirp: tombstone(chirp)}
+	}
+	return tx.renderChirp(chirp, viewer)
+}
+
+// renderChirp is chirpResponse without the tombstone, for authors looking at their trash
+func (tx *Tx) renderChirp(chirp Chirp, viewer ID) ChirpResponse {
+	result := ChirpResponse{Chirp: chirp, Poll: tx.pollResponse(chirp, viewer), Quoted: tx.quotedChirp(chirp.QuoteOf, maxQuoteDepth)}
+	if viewer != 0 {
+		_, result.LikedByMe = tx.data.Likes[reactionKey(chirp.Id, viewer)]
+		_, result.RechirpedByMe = tx.data.Rechirps[reactionKey(chirp.Id, viewer)]
+	}
+	return result
+}
+
+func (tx *Tx) chirpResponses(chirps []Chirp, viewer ID) []ChirpResponse {
+	result := make([]ChirpResponse, 0, len(chirps))
+	for _, chirp := range chirps {
+		result = append(result, tx.chirpResponse(chirp, viewer))
+	}
+	return result
+}
+
+// reactions returns the bucket's records
+func (tx *Tx) reactions(bucket string) map[string]Reaction {
+	if bucket == bucketLikes {
+		return tx.data.Likes
+	}
+	return tx.data.Rechirps
+}
+
+// React adds (on) or removes userId's like or rechirp, selected by bucket, on a chirp.
+// The reaction and the chirp's counter are committed together and
+// repeating an action is a no-op.
+func (db *DB) React(bucket string, chirpId, userId ID, on bool) (ChirpResponse, error) {
+	var result ChirpResponse
+	err := db.Update(func(tx *Tx) error {
+		chirp, ok := tx.data.Chirps[chirpId]
+		if !ok {
+			return ErrNotFound
+		}
+		if chirp.hidden() {
+			return ErrGone
+		}
+		if _, ok := tx.data.Users[userId]; !ok {
+			return ErrForbidden
+		}
+
+		key := reactionKey(chirpId, userId)
+		if _, exists := tx.reactions(bucket)[key]; exists == on {
+			result = tx.chirpResponse(chirp, userId)
+			return nil
+		}
+
+		delta := 1
+		var err error
+		if on {
+			err = tx.put(bucket, key, Reaction{ChirpId: chirpId, UserId: userId, CreatedAt: time.Now().UTC()})
+		} else {
+			delta = -1
+			err = tx.del(bucket, key)
+		}
+		if err != nil {
+			return err
+		}
+
+		if bucket == bucketLikes {
+			chirp.LikeCount += delta
+		} else {
+			chirp.RechirpCount += delta
+		}
+		err = tx.put(bucketChirps, chirp.Id.String(), chirp)
+		if err != nil {
+			return err
+		}
+		result = tx.chirpResponse(chirp, userId)
+		return nil
+	})
+	return result, err
+}
+
+// dropReactions deletes every like and rechirp of a chirp that is going away
+func (tx *Tx) dropReactions(chirpId ID) error {
+	for bucket, users := range map[string][]ID{
+		bucketLikes:    idsOf(tx.data.likesByChirp, chirpId),
+		bucketRechirps: idsOf(tx.data.rechirpsByChirp, chirpId),
+	} {
+		for _, userId := range users {
+			err := tx.del(bucket, reactionKey(chirpId, userId))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// POST /api/chirps/{chirpId}/like -> ChirpResponse
+func (db *DB) HandlePostLike(w http.ResponseWriter, r *http.Request) {
+	db.handleReaction(w, r, bucketLikes, true)
+}
+
+// DELETE /api/chirps/{chirpId}/like -> ChirpResponse
+func (db *DB) HandleDeleteLike(w http.ResponseWriter, r *http.Request) {
+	db.handleReaction(w, r, bucketLikes, false)
+}
+
+// POST /api/chirps/{chirpId}/rechirp -> ChirpResponse
+func (db *DB) HandlePostRechirp(w http.ResponseWriter, r *http.Request) {
+	db.handleReaction(w, r, bucketRechirps, true)
+}
+
+// DELETE /api/chirps/{chirpId}/rechirp -> ChirpResponse
+func (db *DB) HandleDeleteRechirp(w http.ResponseWriter, r *http.Request) {
+	db.handleReaction(w, r, bucketRechirps, false)
+}
+
+func (db *DB) handleReaction(w http.ResponseWriter, r *http.Request, bucket string, on bool) {
+	userId, err := db.authenticate(r)
+	if err != nil {
+		log.Print("Reaction, authenticate:", err.Error())
+		w.WriteHeader(401)
+		return
+	}
+
+	chirpId, err := ParseID(r.PathValue("chirpId"))
+	if err != nil {
+		log.Print("Reaction, ParseID:", err.Error())
+		w.WriteHeader(400)
+		return
+	}
+
+	chirp, err := db.React(bucket, chirpId, userId, on)
+	if errors.Is(err, ErrNotFound) {
+		w.WriteHeader(404)
+		return
+	}
+	if errors.Is(err, ErrGone) {
+		w.WriteHeader(410)
+		return
+	}
+	if errors.Is(err, ErrForbidden) {
+		w.WriteHeader(403)
+		return
+	}
+	if err != nil {
+		log.Print("Reaction, React:", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	err = db.sendJson(w, r, chirp, 200)
+	if err != nil {
+		log.Print("Reaction, SendJson:", err.Error())
+	}
+}
+
+// GET /api/users/{id}/likes -> []ChirpResponse, takes the same query parameters as GET /api/chirps
+func (db *DB) HandleGetUserLikes(w http.ResponseWriter, r *http.Request) {
+	q, err := parseChirpQuery(r)
+	if err != nil {
+		db.sendJson(w, r, api.JsonErr{ErrorMsg: err.Error()}, 400)
+		return
+	}
+	q.LikedBy, err = ParseID(r.PathValue("id"))
+	if err != nil {
+		log.Print("GetUserLikes, ParseID:", err.Error())
+		w.WriteHeader(400)
+		return
+	}
+
+	err = db.View(func(tx *Tx) error {
+		if _, ok := tx.data.Users[q.LikedBy]; !ok {
+			return ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	db.serveChirps(w, r, q)
+}
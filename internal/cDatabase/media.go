@@ -0,0 +1,431 @@
+package cDatabase
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// Limits on media attached to a chirp
+const (
+	maxAttachments = 4
+	maxMediaSize   = 5 << 20
+	// maxMediaPixels stops small files that decode into huge images,
+	// for a GIF it caps the pixels of all frames together
+	maxMediaPixels = 40_000_000
+	maxGIFFrames   = 500
+	thumbnailSize  = 320
+	jpegQuality    = 90
+)
+
+// Attachment is an image posted with a chirp. The image is re-encoded on upload,
+// which drops EXIF and any other metadata, so Hash and Size describe the stored copy.
+type Attachment struct {
+	Hash          string `json:"hash"`
+	ContentType   string `json:"content_type"`
+	Size          int    `json:"size"`
+	Width         int    `json:"width"`
+	Height        int    `json:"height"`
+	URL           string `json:"url"`
+	ThumbnailHash string `json:"thumbnail_hash"`
+	ThumbnailURL  string `json:"thumbnail_url"`
+}
+
+var (
+	errTooManyAttachments = fmt.Errorf("at most %d images can be attached", maxAttachments)
+	errMediaTooLarge      = fmt.Errorf("images must be at most %d bytes", maxMediaSize)
+	errMediaType          = errors.New("images must be jpeg, png or gif")
+	errBadImage           = errors.New("image could not be decoded")
+)
+
+// mediaURL is where GET /media/{hash} serves a blob
+func mediaURL(hash string) string {
+	return "/media/" + hash
+}
+
+// Image is an upload ready to attach, re-encoded along with its thumbnail.
+// Nothing is stored until the chirp it goes with is created.
+type Image struct {
+	Attachment
+	data  []byte
+	thumb []byte
+}
+
+// PrepareImage validates an uploaded image, strips its metadata
+// and makes a thumbnail no larger than thumbnailSize on either side
+func PrepareImage(data []byte) (Image, error) {
+	if len(data) > maxMediaSize {
+		return Image{}, errMediaTooLarge
+	}
+	contentType := http.DetectContentType(data)
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif":
+	default:
+		return Image{}, errMediaType
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return Image{}, errBadImage
+	}
+	if config.Width*config.Height > maxMediaPixels {
+		return Image{}, errMediaTooLarge
+	}
+
+	var clean bytes.Buffer
+	var first image.Image
+	switch contentType {
+	case "image/gif":
+		// the logical screen says nothing about how many frames follow, count them first
+		frames, pixels, err := gifFrames(data)
+		if err != nil || frames > maxGIFFrames || pixels > maxMediaPixels {
+			return Image{}, errBadImage
+		}
+		// keep every frame, GIFs carry no EXIF but may carry comments
+		anim, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return Image{}, errBadImage
+		}
+		first = anim.Image[0]
+		err = gif.EncodeAll(&clean, anim)
+		if err != nil {
+			return Image{}, err
+		}
+	case "image/jpeg":
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return Image{}, errBadImage
+		}
+		// the orientation tag goes with the rest of the EXIF, bake it into the pixels
+		first = orient(img, jpegOrientation(data))
+		err = jpeg.Encode(&clean, first, &jpeg.Options{Quality: jpegQuality})
+		if err != nil {
+			return Image{}, err
+		}
+	case "image/png":
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return Image{}, errBadImage
+		}
+		first = img
+		err = png.Encode(&clean, img)
+		if err != nil {
+			return Image{}, err
+		}
+	}
+
+	var thumb bytes.Buffer
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&thumb, thumbnail(first), &jpeg.Options{Quality: jpegQuality})
+	} else {
+		err = png.Encode(&thumb, thumbnail(first))
+	}
+	if err != nil {
+		return Image{}, err
+	}
+
+	hash, thumbHash := blobHash(clean.Bytes()), blobHash(thumb.Bytes())
+	bounds := first.Bounds()
+	attachment := Attachment{
+		Hash:          hash,
+		ContentType:   contentType,
+		Size:          clean.Len(),
+		Width:         bounds.Dx(),
+		Height:        bounds.Dy(),
+		URL:           mediaURL(hash),
+		ThumbnailHash: thumbHash,
+		ThumbnailURL:  mediaURL(thumbHash),
+	}
+	return Image{Attachment: attachment, data: clean.Bytes(), thumb: thumb.Bytes()}, nil
+}
+
+// storeImages writes the blobs of images and returns their attachments. The blobs count as
+// released until a chirp refers to them, so they are deleted again if the Update fails.
+func (tx *Tx) storeImages(images []Image) ([]Attachment, error) {
+	var result []Attachment
+	for _, img := range images {
+		for _, data := range [][]byte{img.data, img.thumb} {
+			hash, err := tx.blobs.Put(data)
+			if err != nil {
+				return nil, err
+			}
+			tx.data.releasedBlobs = append(tx.data.releasedBlobs, hash)
+		}
+		result = append(result, img.Attachment)
+	}
+	return result, nil
+}
+
+// gifFrames walks the blocks of a GIF without decoding any pixels and returns
+// how many frames it has and their combined width×height
+func gifFrames(data []byte) (frames, pixels int, err error) {
+	errTruncated := errors.New("gif: truncated")
+	if len(data) < 13 {
+		return 0, 0, errTruncated
+	}
+	i := 13
+	// a global color table follows the logical screen descriptor
+	if flags := data[10]; flags&0x80 != 0 {
+		i += 3 << (flags&0x07 + 1)
+	}
+	// skipSubBlocks moves i past a chain of length-prefixed sub-blocks
+	skipSubBlocks := func() error {
+		for {
+			if i >= len(data) {
+				return errTruncated
+			}
+			n := int(data[i])
+			i += 1 + n
+			if n == 0 {
+				return nil
+			}
+		}
+	}
+	for {
+		if i >= len(data) {
+			return 0, 0, errTruncated
+		}
+		switch data[i] {
+		case 0x21: // extension: label, then sub-blocks
+			i += 2
+			err = skipSubBlocks()
+		case 0x2C: // image descriptor
+			if i+10 > len(data) {
+				return 0, 0, errTruncated
+			}
+			w := int(binary.LittleEndian.Uint16(data[i+5:]))
+			h := int(binary.LittleEndian.Uint16(data[i+7:]))
+			frames++
+			pixels += w * h
+			flags := data[i+9]
+			i += 10
+			if flags&0x80 != 0 {
+				i += 3 << (flags&0x07 + 1)
+			}
+			// LZW minimum code size, then the image data
+			i++
+			err = skipSubBlocks()
+		case 0x3B: // trailer
+			return frames, pixels, nil
+		default:
+			return 0, 0, errors.New("gif: unknown block")
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+}
+
+// thumbnail scales img to fit within thumbnailSize, smaller images are kept as they are
+func thumbnail(img image.Image) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= thumbnailSize && h <= thumbnailSize {
+		return img
+	}
+	if w >= h {
+		w, h = thumbnailSize, max(1, h*thumbnailSize/w)
+	} else {
+		w, h = max(1, w*thumbnailSize/h), thumbnailSize
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+// jpegOrientation reads the EXIF orientation tag of a JPEG, 1 (upright) if there is none
+func jpegOrientation(data []byte) int {
+	// walk the segments up to start of scan looking for APP1 "Exif"
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xDA || i+2+length > len(data) {
+			break
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation finds tag 0x0112 in the first IFD of a TIFF block
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 0 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for n := 0; n < entries; n++ {
+		entry := ifd + 2 + 12*n
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			o := int(order.Uint16(tiff[entry+8:]))
+			if o < 1 || o > 8 {
+				return 1
+			}
+			return o
+		}
+	}
+	return 1
+}
+
+// orient applies an EXIF orientation so the image displays upright without the tag
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	// orientations 5 to 8 swap width and height
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			dst.Set(x, y, img.At(bounds.Min.X+sx, bounds.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// receiveChirpForm reads a multipart/form-data chirp: the body, in_reply_to and quote_of
+// fields plus up to maxAttachments images in "media" parts
+func (db *DB) receiveChirpForm(w http.ResponseWriter, r *http.Request) (NewChirp, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachments*maxMediaSize+1<<20)
+	err := r.ParseMultipartForm(maxMediaSize)
+	var tooBig *http.MaxBytesError
+	if errors.As(err, &tooBig) {
+		return NewChirp{}, errMediaTooLarge
+	}
+	if err != nil {
+		return NewChirp{}, err
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	result := NewChirp{Body: r.FormValue("body")}
+	if s := r.FormValue("in_reply_to"); s != "" {
+		result.InReplyTo, err = ParseID(s)
+		if err != nil {
+			return NewChirp{}, errBadReply
+		}
+	}
+	if s := r.FormValue("quote_of"); s != "" {
+		result.QuoteOf, err = ParseID(s)
+		if err != nil {
+			return NewChirp{}, errBadQuote
+		}
+	}
+
+	files := r.MultipartForm.File["media"]
+	if len(files) > maxAttachments {
+		return NewChirp{}, errTooManyAttachments
+	}
+	for _, fh := range files {
+		if fh.Size > maxMediaSize {
+			return NewChirp{}, errMediaTooLarge
+		}
+		data, err := readFormFile(fh)
+		if err != nil {
+			return NewChirp{}, err
+		}
+		img, err := PrepareImage(data)
+		if err != nil {
+			return NewChirp{}, err
+		}
+		result.Images = append(result.Images, img)
+	}
+	return result, nil
+}
+
+func readFormFile(fh *multipart.FileHeader) ([]byte, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(io.LimitReader(f, maxMediaSize+1))
+}
+
+// mediaErrorStatus is the status for an upload rejected by receiveChirpForm, 0 for other errors
+func mediaErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errMediaTooLarge):
+		return 413
+	case errors.Is(err, errMediaType):
+		return 415
+	case errors.Is(err, errTooManyAttachments), errors.Is(err, errBadImage):
+		return 400
+	}
+	return 0
+}
+
+// GET /media/{hash}
+//
+// Blobs never change, so they can be cached for good.
+func (db *DB) HandleGetMedia(w http.ResponseWriter, r *http.Request) {
+	hash := r.PathValue("hash")
+	blob, err := db.blobs.Open(hash)
+	if errors.Is(err, ErrNotFound) {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		log.Print("GetMedia, Open:", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+	defer blob.Close()
+
+	w.Header().Set("ETag", strconv.Quote(hash))
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", time.Time{}, blob)
+}
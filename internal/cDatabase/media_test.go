@@ -0,0 +1,161 @@
+package cDatabase
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"internal/api"
+	"strings"
+	"testing"
+)
+
+// encodeGIF builds an animation of frames blank w×h frames
+func encodeGIF(t *testing.T, frames, w, h int) []byte {
+	t.Helper()
+	anim := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, w, h), palette.Plan9))
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, anim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGIFFrameLimits(t *testing.T) {
+	small := encodeGIF(t, 3, 40, 30)
+	frames, pixels, err := gifFrames(small)
+	if err != nil || frames != 3 || pixels != 3*40*30 {
+		t.Errorf("gifFrames = %d, %d, %v, want 3, %d", frames, pixels, err, 3*40*30)
+	}
+	_, err = PrepareImage(small)
+	if err != nil {
+		t.Errorf("small animation rejected: %v", err)
+	}
+
+	for name, data := range map[string][]byte{
+		"too many frames":  encodeGIF(t, maxGIFFrames+1, 1, 1),
+		"too many pixels":  encodeGIF(t, 11, 2000, 2000),
+		"missing trailer":  small[:len(small)-1],
+		"truncated header": small[:12],
+	} {
+		_, err := PrepareImage(data)
+		if !errors.Is(err, errBadImage) {
+			t.Errorf("%s: got %v, want errBadImage", name, err)
+		}
+	}
+}
+
+// TestPurgeDeletesBlobs shares one image between two chirps,
+// its blobs must outlive the first purge and go with the second
+func TestPurgeDeletesBlobs(t *testing.T) {
+	db := newTestDB(t, newMemStore())
+	user, err := db.createUser("user@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := PrepareImage(encodeGIF(t, 1, 400, 300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chirps []Chirp
+	for i := 0; i < 2; i++ {
+		chirp, err := db.CreateChirp(NewChirp{Body: "picture", AuthorId: user.Id, Images: []Image{img}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.DeleteChirp(chirp.Id, user.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chirps = append(chirps, chirp)
+	}
+
+	err = db.Update(func(tx *Tx) error {
+		return tx.purgeChirp(tx.data.Chirps[chirps[0].Id])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := storedBlobs(t, db, img); n != 2 {
+		t.Fatalf("%d of 2 blobs left while a trashed chirp still refers to them", n)
+	}
+	err = db.Update(func(tx *Tx) error {
+		return tx.purgeChirp(tx.data.Chirps[chirps[1].Id])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := storedBlobs(t, db, img); n != 0 {
+		t.Errorf("%d blobs kept after the last chirp referring to them was purged", n)
+	}
+}
+
+// storedBlobs counts how many of img and its thumbnail are in db's blob store
+func storedBlobs(t *testing.T, db *DB, img Image) int {
+	t.Helper()
+	n := 0
+	for _, hash := range []string{img.Hash, img.ThumbnailHash} {
+		blob, err := db.blobs.Open(hash)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob.Close()
+		n++
+	}
+	return n
+}
+
+// TestFailedChirpStoresNoBlobs checks that images only reach the blob store
+// with a chirp that is actually created
+func TestFailedChirpStoresNoBlobs(t *testing.T) {
+	db := newTestDB(t, newMemStore())
+	user, err := db.createUser("user@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := PrepareImage(encodeGIF(t, 1, 400, 300))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.CreateChirp(NewChirp{Body: strings.Repeat("a", api.MaxChirpLength+1), AuthorId: user.Id, Images: []Image{img}})
+	if !errors.Is(err, errChirpTooLong) {
+		t.Fatalf("got %v, want errChirpTooLong", err)
+	}
+	if n := storedBlobs(t, db, img); n != 0 {
+		t.Errorf("%d blobs stored for a chirp that failed validation", n)
+	}
+
+	// blobs written before a later step of the same Update fails go as well
+	errBoom := errors.New("boom")
+	err = db.Update(func(tx *Tx) error {
+		_, err := tx.createChirp(NewChirp{Body: "picture", AuthorId: user.Id, Images: []Image{img}})
+		if err != nil {
+			return err
+		}
+		return errBoom
+	})
+	if !errors.Is(err, errBoom) {
+		t.Fatalf("got %v, want errBoom", err)
+	}
+	if n := storedBlobs(t, db, img); n != 0 {
+		t.Errorf("%d blobs left behind by a rolled back chirp", n)
+	}
+
+	_, err = db.CreateChirp(NewChirp{Body: "picture", AuthorId: user.Id, Images: []Image{img}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := storedBlobs(t, db, img); n != 2 {
+		t.Errorf("%d of 2 blobs stored for a created chirp", n)
+	}
+}
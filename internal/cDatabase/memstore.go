@@ -0,0 +1,67 @@
+package cDatabase
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// memStore keeps the dataset in memory only, for tests and throwaway servers
+type memStore struct {
+	mux  sync.Mutex
+	data DBStructure
+}
+
+func newMemStore() *memStore {
+	return &memStore{data: newDBStructure()}
+}
+
+// Load returns a copy of the dataset so callers can't mutate the store behind its back
+func (ms *memStore) Load() (DBStructure, error) {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+	return copyDBStructure(ms.data)
+}
+
+// Commit applies changes to a copy first so a bad change leaves the store untouched
+func (ms *memStore) Commit(changes []change) error {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+
+	next, err := copyDBStructure(ms.data)
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		err = next.apply(c)
+		if err != nil {
+			return err
+		}
+	}
+	ms.data = next
+	return nil
+}
+
+func (ms *memStore) Snapshot(dbStruct DBStructure) error {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+
+	next, err := copyDBStructure(dbStruct)
+	if err != nil {
+		return err
+	}
+	ms.data = next
+	return nil
+}
+
+func (ms *memStore) Close() error {
+	return nil
+}
+
+// copyDBStructure deep copies dbStruct by round tripping it through JSON
+func copyDBStructure(dbStruct DBStructure) (DBStructure, error) {
+	dat, err := json.Marshal(dbStruct)
+	if err != nil {
+		return DBStructure{}, err
+	}
+	return decodeDB(dat)
+}
@@ -0,0 +1,419 @@
+package cDatabase
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// migration moves a database document from version-1 to version
+type migration struct {
+	version     int
+	description string
+	up          func(doc map[string]interface{}) error
+}
+
+// migrations are applied in order on load, append new ones at the end
+// and never edit one that has shipped
+var migrations = []migration{
+	{
+		version:     1,
+		description: "add webhook_events and sequences, start each sequence at the highest id in use",
+		up: func(doc map[string]interface{}) error {
+			for _, bucket := range []string{bucketChirps, bucketUsers, bucketRTokens, bucketWebhookEvents, bucketSequences} {
+				if _, ok := doc[bucket].(map[string]interface{}); !ok {
+					doc[bucket] = map[string]interface{}{}
+				}
+			}
+			sequences := doc[bucketSequences].(map[string]interface{})
+			for _, bucket := range []string{bucketChirps, bucketUsers, bucketWebhookEvents} {
+				if _, ok := sequences[bucket]; ok {
+					continue
+				}
+				var max int64
+				for key := range doc[bucket].(map[string]interface{}) {
+					id, err := strconv.ParseInt(key, 10, 64)
+					if err != nil {
+						return fmt.Errorf("%s key %q: %w", bucket, key, err)
+					}
+					if id > max {
+						max = id
+					}
+				}
+				sequences[bucket] = max
+			}
+			return nil
+		},
+	},
+	{
+		version:     2,
+		description: "backfill created_at and updated_at on chirps and users",
+		up: func(doc map[string]interface{}) error {
+			now := time.Now().UTC()
+			for _, bucket := range []string{bucketChirps, bucketUsers} {
+				records, _ := doc[bucket].(map[string]interface{})
+				for key, value := range records {
+					record, ok := value.(map[string]interface{})
+					if !ok {
+						return fmt.Errorf("%s key %q: not an object", bucket, key)
+					}
+					if _, ok := record["created_at"]; ok {
+						continue
+					}
+					// snowflake ids carry their creation time, sequence ids don't
+					createdAt := now
+					id, err := strconv.ParseInt(key, 10, 64)
+					if err == nil && id >= 1<<snowflakeShift {
+						createdAt = time.UnixMilli((id >> snowflakeShift) + idEpoch).UTC()
+					}
+					record["created_at"] = createdAt.Format(time.RFC3339Nano)
+					record["updated_at"] = createdAt.Format(time.RFC3339Nano)
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version:     3,
+		description: "extract tags and mentions from existing chirp bodies",
+		up: func(doc map[string]interface{}) error {
+			users, _ := doc[bucketUsers].(map[string]interface{})
+			idsByEmail := make(map[string]string, len(users))
+			for key, value := range users {
+				if user, ok := value.(map[string]interface{}); ok {
+					if email, ok := user["email"].(string); ok {
+						idsByEmail[email] = key
+					}
+				}
+			}
+
+			chirps, _ := doc[bucketChirps].(map[string]interface{})
+			for key, value := range chirps {
+				chirp, ok := value.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("%s key %q: not an object", bucketChirps, key)
+				}
+				body, _ := chirp["body"].(string)
+				if tags := extractTags(body); len(tags) > 0 {
+					chirp["tags"] = tags
+				}
+				var mentions []string
+				for _, email := range extractMentions(body) {
+					if id, ok := idsByEmail[email]; ok {
+						mentions = append(mentions, id)
+					}
+				}
+				if len(mentions) > 0 {
+					chirp["mentions"] = mentions
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version:     4,
+		description: "add likes and rechirps",
+		up: func(doc map[string]interface{}) error {
+			for _, bucket := range []string{bucketLikes, bucketRechirps} {
+				if _, ok := doc[bucket].(map[string]interface{}); !ok {
+					doc[bucket] = map[string]interface{}{}
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version:     5,
+		description: "add follows",
+		up: func(doc map[string]interface{}) error {
+			if _, ok := doc[bucketFollows].(map[string]interface{}); !ok {
+				doc[bucketFollows] = map[string]interface{}{}
+			}
+			return nil
+		},
+	},
+	{
+		version:     6,
+		description: "add revisions",
+		up: func(doc map[string]interface{}) error {
+			if _, ok := doc[bucketRevisions].(map[string]interface{}); !ok {
+				doc[bucketRevisions] = map[string]interface{}{}
+			}
+			return nil
+		},
+	},
+	{
+		version:     7,
+		description: "stamp deleted_at on existing tombstones",
+		up: func(doc map[string]interface{}) error {
+			chirps, _ := doc[bucketChirps].(map[string]interface{})
+			for key, value := range chirps {
+				chirp, ok := value.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("%s key %q: not an object", bucketChirps, key)
+				}
+				if deleted, _ := chirp["deleted"].(bool); deleted && chirp["deleted_at"] == nil {
+					chirp["deleted_at"] = chirp["updated_at"]
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version:     8,
+		description: "add drafts",
+		up: func(doc map[string]interface{}) error {
+			if _, ok := doc[bucketDrafts].(map[string]interface{}); !ok {
+				doc[bucketDrafts] = map[string]interface{}{}
+			}
+			return nil
+		},
+	},
+	{
+		version:     9,
+		description: "add votes",
+		up: func(doc map[string]interface{}) error {
+			if _, ok := doc[bucketVotes].(map[string]interface{}); !ok {
+				doc[bucketVotes] = map[string]interface{}{}
+			}
+			return nil
+		},
+	},
+	{
+		version:     10,
+		description: "add collections and bookmarks",
+		up: func(doc map[string]interface{}) error {
+			for _, bucket := range []string{bucketCollections, bucketBookmarks} {
+				if _, ok := doc[bucket].(map[string]interface{}); !ok {
+					doc[bucket] = map[string]interface{}{}
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version:     11,
+		description: "rewrite @email mentions in chirps and revisions to @id",
+		up: func(doc map[string]interface{}) error {
+			users, _ := doc[bucketUsers].(map[string]interface{})
+			idsByEmail := make(map[string]ID, len(users))
+			for key, value := range users {
+				user, _ := value.(map[string]interface{})
+				email, _ := user["email"].(string)
+				id, err := ParseID(key)
+				if err == nil && email != "" {
+					idsByEmail[email] = id
+				}
+			}
+			idOf := func(email string) (ID, bool) {
+				id, ok := idsByEmail[email]
+				return id, ok
+			}
+
+			for _, bucket := range []string{bucketChirps, bucketRevisions} {
+				records, _ := doc[bucket].(map[string]interface{})
+				for key, value := range records {
+					record, ok := value.(map[string]interface{})
+					if !ok {
+						return fmt.Errorf("%s key %q: not an object", bucket, key)
+					}
+					if body, ok := record["body"].(string); ok {
+						record["body"] = replaceEmailMentions(body, idOf)
+					}
+				}
+			}
+			return nil
+		},
+	},
+}
+
+// currentSchemaVersion is the version this binary reads and writes
+var currentSchemaVersion = len(migrations)
+
+// MigrationReport describes one migration that was, or in a dry run would be, applied
+type MigrationReport struct {
+	From        int      `json:"from"`
+	To          int      `json:"to"`
+	Description string   `json:"description"`
+	Changes     []string `json:"changes"`
+}
+
+// migrateDocument brings a database document up to currentSchemaVersion.
+// dat is returned untouched if it is already current.
+func migrateDocument(dat []byte) ([]byte, []MigrationReport, error) {
+	if len(dat) == 0 {
+		return dat, nil, nil
+	}
+
+	var header struct {
+		SchemaVersion int `json:"schema_version"`
+	}
+	err := json.Unmarshal(dat, &header)
+	if err != nil {
+		return nil, nil, err
+	}
+	if header.SchemaVersion == currentSchemaVersion {
+		return dat, nil, nil
+	}
+	if header.SchemaVersion > currentSchemaVersion {
+		return nil, nil, fmt.Errorf("database schema v%d is newer than this binary supports (v%d)", header.SchemaVersion, currentSchemaVersion)
+	}
+
+	doc, err := decodeDocument(dat)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var reports []MigrationReport
+	for _, m := range migrations[header.SchemaVersion:] {
+		before, err := copyDocument(doc)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = m.up(doc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("migration to v%d: %w", m.version, err)
+		}
+		doc["schema_version"] = m.version
+
+		reports = append(reports, MigrationReport{
+			From:        m.version - 1,
+			To:          m.version,
+			Description: m.description,
+			Changes:     diffDocuments(before, doc),
+		})
+	}
+
+	dat, err = json.Marshal(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dat, reports, nil
+}
+
+// PlanMigrations reports which migrations NewDB would apply to the database in cfg,
+// without writing anything
+func PlanMigrations(cfg Config) ([]MigrationReport, error) {
+	var dat []byte
+	var err error
+	switch cfg.Backend {
+	case "", BackendJSON:
+		var keys *keyring
+		keys, err = newKeyring(cfg.EncryptionKey, cfg.PreviousEncryptionKeys)
+		if err != nil {
+			return nil, err
+		}
+		dat, err = os.ReadFile(cfg.Path)
+		if err == nil {
+			dat, err = keys.open(dat)
+		}
+		if err == nil {
+			// report on the journal as well, Load migrates it along with the file
+			var entries []journalEntry
+			entries, err = (&fileStore{path: cfg.Path, keys: keys}).readJournal()
+			if err == nil {
+				dat, err = replayOutdated(dat, entries)
+			}
+		}
+	case BackendSQLite:
+		dat, err = readSQLiteDocument(cfg.Path)
+	case BackendMemory:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown database backend %q", cfg.Backend)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, reports, err := migrateDocument(dat)
+	return reports, err
+}
+
+// readSQLiteDocument opens the SQLite database at path read-only and returns its document
+func readSQLiteDocument(path string) ([]byte, error) {
+	_, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return (&sqliteStore{db: db}).document()
+}
+
+// decodeDocument unmarshals a database document for the migrations,
+// numbers stay json.Number so snowflake ids keep every digit
+func decodeDocument(dat []byte) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(dat))
+	dec.UseNumber()
+	var doc map[string]interface{}
+	err := dec.Decode(&doc)
+	return doc, err
+}
+
+func copyDocument(doc map[string]interface{}) (map[string]interface{}, error) {
+	dat, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return decodeDocument(dat)
+}
+
+// diffDocuments summarises what changed per top-level key, one line each
+func diffDocuments(before, after map[string]interface{}) []string {
+	keys := make(map[string]bool)
+	for key := range before {
+		keys[key] = true
+	}
+	for key := range after {
+		keys[key] = true
+	}
+
+	var result []string
+	for key := range keys {
+		if key == "schema_version" || reflect.DeepEqual(before[key], after[key]) {
+			continue
+		}
+		oldBucket, oldOk := before[key].(map[string]interface{})
+		newBucket, newOk := after[key].(map[string]interface{})
+		if before[key] == nil && newOk {
+			result = append(result, fmt.Sprintf("%s: created with %d records", key, len(newBucket)))
+			continue
+		}
+		if !oldOk || !newOk {
+			result = append(result, fmt.Sprintf("%s: set", key))
+			continue
+		}
+
+		added, removed, changed := 0, 0, 0
+		for k, v := range newBucket {
+			old, ok := oldBucket[k]
+			if !ok {
+				added++
+			} else if !reflect.DeepEqual(old, v) {
+				changed++
+			}
+		}
+		for k := range oldBucket {
+			if _, ok := newBucket[k]; !ok {
+				removed++
+			}
+		}
+		result = append(result, fmt.Sprintf("%s: %d added, %d changed, %d removed", key, added, changed, removed))
+	}
+	sort.Strings(result)
+	return result
+}
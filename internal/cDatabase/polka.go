@@ -1,10 +1,11 @@
 package cDatabase
 
 import (
+	"errors"
 	"internal/api"
 	"log"
 	"net/http"
-	"strings"
+	"time"
 )
 
 type PolkaRequest struct {
@@ -13,19 +14,12 @@ type PolkaRequest struct {
 }
 
 type Data struct {
-	UserId int `json:"user_id"`
+	UserId ID `json:"user_id"`
 }
 
 func (db *DB) HandlePolkaPostWebHook(w http.ResponseWriter, r *http.Request) {
 
-	header := r.Header.Get("Authorization")
-	AuthString := strings.Split(header, " ")
-	if len(AuthString) < 2 {
-		w.WriteHeader(401)
-		return
-	}
-	key := AuthString[1]
-	if key != db.polkaApi {
+	if !hasApiKey(r, db.polkaApi) {
 		w.WriteHeader(401)
 		return
 	}
@@ -38,6 +32,13 @@ func (db *DB) HandlePolkaPostWebHook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = db.recordWebhookEvent(requestBody.Event, requestBody.Data.UserId)
+	if err != nil {
+		log.Print("PolkaPostWH, recordWebhookEvent:", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
 	if requestBody.Event != "user.upgraded" {
 		w.WriteHeader(204)
 		return
@@ -46,7 +47,7 @@ func (db *DB) HandlePolkaPostWebHook(w http.ResponseWriter, r *http.Request) {
 	if requestBody.Event == "user.upgraded" {
 		err = db.UpgradeUser(requestBody.Data.UserId)
 		if err != nil {
-			if err.Error() == "404" {
+			if errors.Is(err, ErrNotFound) {
 				w.WriteHeader(404)
 				return
 			}
@@ -54,3 +55,22 @@ func (db *DB) HandlePolkaPostWebHook(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(204)
 	}
 }
+
+// WebhookEvent records a webhook delivery from Polka
+type WebhookEvent struct {
+	Id         ID        `json:"id"`
+	Event      string    `json:"event"`
+	UserId     ID        `json:"user_id"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// recordWebhookEvent stores a received webhook event
+func (db *DB) recordWebhookEvent(event string, userId ID) error {
+	return db.Update(func(tx *Tx) error {
+		id, err := tx.nextID(bucketWebhookEvents)
+		if err != nil {
+			return err
+		}
+		return tx.put(bucketWebhookEvents, id.String(), WebhookEvent{Id: id, Event: event, UserId: userId, ReceivedAt: time.Now()})
+	})
+}
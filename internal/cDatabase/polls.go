@@ -0,0 +1,320 @@
+package cDatabase
+
+import (
+	"errors"
+	"fmt"
+	"internal/api"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Limits on polls attached to chirps
+const (
+	minPollOptions  = 2
+	maxPollOptions  = 4
+	maxPollDuration = 7 * 24 * time.Hour
+)
+
+// Poll is a question attached to a chirp. Tallies counts the votes for each option
+// and Voters the users who voted, both move in the same transaction as the votes.
+// Closed is set by the scheduler once ClosesAt has passed.
+type Poll struct {
+	Options  []string  `json:"options"`
+	Multiple bool      `json:"multiple"`
+	ClosesAt time.Time `json:"closes_at"`
+	Closed   bool      `json:"closed"`
+	Tallies  []int     `json:"tallies,omitempty"`
+	Voters   int       `json:"voters"`
+}
+
+// PollResponse is a poll as seen by the user making the request. Tallies are
+// left out until the viewer has voted or the poll has closed.
+type PollResponse struct {
+	Poll
+	ResultsVisible bool `json:"results_visible"`
+	// MyVote is the options the viewer picked, empty if they haven't voted
+	MyVote []int `json:"my_vote"`
+}
+
+// Vote is one user's answer to the poll on one chirp
+type Vote struct {
+	ChirpId   ID        `json:"chirp_id"`
+	UserId    ID        `json:"user_id"`
+	Options   []int     `json:"options"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type pollRequest struct {
+	Options  []string  `json:"options"`
+	Multiple bool      `json:"multiple"`
+	ClosesAt time.Time `json:"closes_at"`
+}
+
+var (
+	errBadPoll      = fmt.Errorf("polls need %d to %d non-empty options and closes_at within %s", minPollOptions, maxPollOptions, maxPollDuration)
+	errNoPoll       = errors.New("chirp has no poll")
+	errBadVote      = errors.New("options must pick existing poll options, exactly one unless the poll is multiple choice")
+	errAlreadyVoted = errors.New("already voted in this poll")
+	errPollClosed   = errors.New("poll has closed")
+)
+
+// newPoll validates what a client asked for and returns a poll with empty tallies
+func newPoll(p pollRequest) (*Poll, error) {
+	if len(p.Options) < minPollOptions || len(p.Options) > maxPollOptions {
+		return nil, errBadPoll
+	}
+	for _, option := range p.Options {
+		if strings.TrimSpace(option) == "" {
+			return nil, errBadPoll
+		}
+	}
+	until := time.Until(p.ClosesAt)
+	if until <= 0 || until > maxPollDuration {
+		return nil, errBadPoll
+	}
+	return &Poll{
+		Options:  p.Options,
+		Multiple: p.Multiple,
+		ClosesAt: p.ClosesAt.UTC(),
+		Tallies:  make([]int, len(p.Options)),
+	}, nil
+}
+
+// open reports whether the poll still takes votes, the scheduler may not have closed it yet
+func (p *Poll) open(now time.Time) bool {
+	return !p.Closed && now.Before(p.ClosesAt)
+}
+
+// view renders the poll for a viewer who picked myVote, nil if they haven't voted
+func (p *Poll) view(myVote []int) *PollResponse {
+	if p == nil {
+		return nil
+	}
+	result := &PollResponse{Poll: *p, MyVote: myVote}
+	if result.MyVote == nil {
+		result.MyVote = []int{}
+	}
+	result.ResultsVisible = myVote != nil || !p.open(time.Now())
+	if !result.ResultsVisible {
+		result.Tallies = nil
+	}
+	return result
+}
+
+// pollResponse renders chirp's poll for viewer, nil if it has none
+func (tx *Tx) pollResponse(chirp Chirp, viewer ID) *PollResponse {
+	if chirp.Poll == nil {
+		return nil
+	}
+	var myVote []int
+	if vote, ok := tx.data.Votes[reactionKey(chirp.Id, viewer)]; ok && viewer != 0 {
+		myVote = vote.Options
+	}
+	return chirp.Poll.view(myVote)
+}
+
+// CastVote records userId's answer to the poll on a chirp, each user votes once
+func (db *DB) CastVote(chirpId, userId ID, options []int) (ChirpResponse, error) {
+	var result ChirpResponse
+	err := db.Update(func(tx *Tx) error {
+		chirp, ok := tx.data.Chirps[chirpId]
+		if !ok {
+			return ErrNotFound
+		}
+		if chirp.hidden() {
+			return ErrGone
+		}
+		if chirp.Poll == nil {
+			return errNoPoll
+		}
+		if _, ok := tx.data.Users[userId]; !ok {
+			return ErrForbidden
+		}
+		if !chirp.Poll.open(time.Now()) {
+			return errPollClosed
+		}
+		key := reactionKey(chirpId, userId)
+		if _, ok := tx.data.Votes[key]; ok {
+			return errAlreadyVoted
+		}
+		if len(options) == 0 || (len(options) > 1 && !chirp.Poll.Multiple) {
+			return errBadVote
+		}
+		options = slices.Clone(options)
+		slices.Sort(options)
+		for i, option := range options {
+			if option < 0 || option >= len(chirp.Poll.Options) || (i > 0 && options[i-1] == option) {
+				return errBadVote
+			}
+		}
+
+		err := tx.put(bucketVotes, key, Vote{ChirpId: chirpId, UserId: userId, Options: options, CreatedAt: time.Now().UTC()})
+		if err != nil {
+			return err
+		}
+		poll := *chirp.Poll
+		poll.Tallies = slices.Clone(poll.Tallies)
+		for _, option := range options {
+			poll.Tallies[option]++
+		}
+		poll.Voters++
+		chirp.Poll = &poll
+		err = tx.put(bucketChirps, chirp.Id.String(), chirp)
+		if err != nil {
+			return err
+		}
+		result = tx.chirpResponse(chirp, userId)
+		return nil
+	})
+	return result, err
+}
+
+// GetPoll returns the poll on a chirp as viewer sees it
+func (db *DB) GetPoll(chirpId, viewer ID) (*PollResponse, error) {
+	var result *PollResponse
+	err := db.View(func(tx *Tx) error {
+		chirp, ok := tx.data.Chirps[chirpId]
+		if !ok {
+			return ErrNotFound
+		}
+		if chirp.hidden() {
+			return ErrGone
+		}
+		if chirp.Poll == nil {
+			return errNoPoll
+		}
+		result = tx.pollResponse(chirp, viewer)
+		return nil
+	})
+	return result, err
+}
+
+// ClosePolls closes every open poll whose closing time is at or before now,
+// and returns how many it closed
+func (db *DB) ClosePolls(now time.Time) (int, error) {
+	closed := 0
+	err := db.Update(func(tx *Tx) error {
+		for _, id := range slices.Clone(tx.data.openPolls) {
+			chirp := tx.data.Chirps[id]
+			if chirp.Poll.ClosesAt.After(now) {
+				continue
+			}
+			poll := *chirp.Poll
+			poll.Closed = true
+			chirp.Poll = &poll
+			err := tx.put(bucketChirps, chirp.Id.String(), chirp)
+			if err != nil {
+				return err
+			}
+			closed++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return closed, nil
+}
+
+// dropVotes deletes the votes on a chirp that is going away
+func (tx *Tx) dropVotes(chirpId ID) error {
+	for _, userId := range idsOf(tx.data.votesByChirp, chirpId) {
+		err := tx.del(bucketVotes, reactionKey(chirpId, userId))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// { H{"Authorization: Bearer ${jwtToken}"}, {options: [index, ...]} } -> ChirpResponse
+func (db *DB) HandlePostVote(w http.ResponseWriter, r *http.Request) {
+	userId, err := db.authenticate(r)
+	if err != nil {
+		log.Print("PostVote, authenticate:", err.Error())
+		w.WriteHeader(401)
+		return
+	}
+
+	chirpId, err := ParseID(r.PathValue("chirpId"))
+	if err != nil {
+		log.Print("PostVote, ParseID:", err.Error())
+		w.WriteHeader(400)
+		return
+	}
+
+	var request struct {
+		Options []int `json:"options"`
+	}
+	err = api.RecieveJson(w, r, &request)
+	if err != nil {
+		log.Print("PostVote, RecieveJson:", err.Error())
+		w.WriteHeader(400)
+		return
+	}
+
+	chirp, err := db.CastVote(chirpId, userId, request.Options)
+	if errors.Is(err, ErrNotFound) || errors.Is(err, errNoPoll) {
+		w.WriteHeader(404)
+		return
+	}
+	if errors.Is(err, ErrGone) {
+		w.WriteHeader(410)
+		return
+	}
+	if errors.Is(err, ErrForbidden) {
+		w.WriteHeader(403)
+		return
+	}
+	if errors.Is(err, errBadVote) {
+		db.sendJson(w, r, api.JsonErr{ErrorMsg: err.Error()}, 400)
+		return
+	}
+	if errors.Is(err, errAlreadyVoted) || errors.Is(err, errPollClosed) {
+		db.sendJson(w, r, api.JsonErr{ErrorMsg: err.Error()}, 409)
+		return
+	}
+	if err != nil {
+		log.Print("PostVote, CastVote:", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	err = db.sendJson(w, r, chirp, 200)
+	if err != nil {
+		log.Print("PostVote, SendJson:", err.Error())
+	}
+}
+
+// GET /api/chirps/{chirpId}/poll -> PollResponse
+func (db *DB) HandleGetPoll(w http.ResponseWriter, r *http.Request) {
+	chirpId, err := ParseID(r.PathValue("chirpId"))
+	if err != nil {
+		log.Print("GetPoll, ParseID:", err.Error())
+		w.WriteHeader(400)
+		return
+	}
+
+	poll, err := db.GetPoll(chirpId, db.viewerId(r))
+	if errors.Is(err, ErrNotFound) || errors.Is(err, errNoPoll) {
+		w.WriteHeader(404)
+		return
+	}
+	if errors.Is(err, ErrGone) {
+		w.WriteHeader(410)
+		return
+	}
+	if err != nil {
+		log.Print("GetPoll:", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	err = db.sendJson(w, r, poll, 200)
+	if err != nil {
+		log.Print("GetPoll, SendJson:", err.Error())
+	}
+}
@@ -0,0 +1,96 @@
+package cDatabase
+
+import (
+	"errors"
+	"internal/api"
+	"log"
+	"net/http"
+	"time"
+)
+
+// maxQuoteDepth is how many levels of quoted chirps a response embeds,
+// deeper quotes are only referenced by QuotedChirp.QuoteOf
+const maxQuoteDepth = 2
+
+// QuotedChirp is the trimmed copy of a quoted chirp embedded in the chirp quoting it.
+// A deleted original shows as a tombstone with only its id and "deleted": true.
+type QuotedChirp struct {
+	Id        ID           `json:"id"`
+	Deleted   bool         `json:"deleted,omitempty"`
+	Body      string       `json:"body,omitempty"`
+	Author    *PublicUser  `json:"author,omitempty"`
+	CreatedAt *time.Time   `json:"created_at,omitempty"`
+	QuoteOf   ID           `json:"quote_of,omitempty"`
+	Quoted    *QuotedChirp `json:"quoted,omitempty"`
+}
+
+var errBadQuote = errors.New("quote_of must be an existing chirp")
+
+// checkQuote returns errBadQuote unless quotedId is 0 or a live chirp
+func (tx *Tx) checkQuote(quotedId ID) error {
+	if quotedId == 0 {
+		return nil
+	}
+	quoted, ok := tx.data.Chirps[quotedId]
+	if !ok || quoted.hidden() {
+		return errBadQuote
+	}
+	return nil
+}
+
+// quotedChirp embeds the chirp with id quotedId and depth levels of what it quotes in turn,
+// nil if quotedId is 0 or depth has run out
+func (tx *Tx) quotedChirp(quotedId ID, depth int) *QuotedChirp {
+	if quotedId == 0 || depth <= 0 {
+		return nil
+	}
+	chirp, ok := tx.data.Chirps[quotedId]
+	if !ok || chirp.hidden() {
+		return &QuotedChirp{Id: quotedId, Deleted: true}
+	}
+	author := publicUser(tx.data.Users[chirp.AuthorId])
+	return &QuotedChirp{
+		Id:        chirp.Id,
+		Body:      chirp.Body,
+		Author:    &author,
+		CreatedAt: &chirp.CreatedAt,
+		QuoteOf:   chirp.QuoteOf,
+		Quoted:    tx.quotedChirp(chirp.QuoteOf, depth-1),
+	}
+}
+
+// GET /api/chirps/{chirpId}/quotes -> []ChirpResponse, takes the same query parameters as GET /api/chirps
+func (db *DB) HandleGetQuotes(w http.ResponseWriter, r *http.Request) {
+	q, err := parseChirpQuery(r)
+	if err != nil {
+		db.sendJson(w, r, api.JsonErr{ErrorMsg: err.Error()}, 400)
+		return
+	}
+	q.QuoteOf, err = ParseID(r.PathValue("chirpId"))
+	if err != nil {
+		log.Print("GetQuotes, ParseID:", err.Error())
+		w.WriteHeader(400)
+		return
+	}
+
+	err = db.View(func(tx *Tx) error {
+		chirp, ok := tx.data.Chirps[q.QuoteOf]
+		if !ok {
+			return ErrNotFound
+		}
+		if chirp.hidden() {
+			return ErrGone
+		}
+		return nil
+	})
+	if errors.Is(err, ErrGone) {
+		w.WriteHeader(410)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	db.serveChirps(w, r, q)
+}
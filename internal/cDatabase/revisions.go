@@ -0,0 +1,202 @@
+package cDatabase
+
+import (
+	"errors"
+	"internal/api"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Revision is a body a chirp had before it was edited,
+// CreatedAt is when the body was posted or edited in and ReplacedAt when it was edited out
+type Revision struct {
+	Id         ID        `json:"id"`
+	ChirpId    ID        `json:"chirp_id"`
+	Body       string    `json:"body"`
+	CreatedAt  time.Time `json:"created_at"`
+	ReplacedAt time.Time `json:"replaced_at"`
+}
+
+var (
+	errEditWindowClosed = errors.New("the edit window for this chirp has closed")
+	errEmptyBody        = errors.New("body must not be empty")
+)
+
+// editWindowFor is how long after posting user may edit their chirps
+func (db *DB) editWindowFor(user User) time.Duration {
+	if user.IsChirpyRed {
+		return db.editWindowRed
+	}
+	return db.editWindow
+}
+
+// EditChirp replaces the body of a chirp, userId must be its author and still inside
+// their edit window. The old body is kept as a Revision.
+func (db *DB) EditChirp(chirpId, userId ID, body string) (ChirpResponse, error) {
+	if strings.TrimSpace(body) == "" {
+		return ChirpResponse{}, errEmptyBody
+	}
+
+	var result ChirpResponse
+	err := db.Update(func(tx *Tx) error {
+		chirp, err := tx.ownChirp(chirpId, userId)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		if now.Sub(chirp.CreatedAt) > db.editWindowFor(tx.data.Users[userId]) {
+			return errEditWindowClosed
+		}
+
+		checked, flagged, err := tx.checkBody(tx.rewriteMentions(body))
+		if err != nil {
+			return err
+		}
+
+		id, err := tx.nextID(bucketRevisions)
+		if err != nil {
+			return err
+		}
+		revision := Revision{Id: id, ChirpId: chirp.Id, Body: chirp.Body, CreatedAt: chirp.CreatedAt, ReplacedAt: now}
+		if chirp.EditedAt != nil {
+			revision.CreatedAt = *chirp.EditedAt
+		}
+		err = tx.put(bucketRevisions, id.String(), revision)
+		if err != nil {
+			return err
+		}
+
+		chirp.Body, chirp.Flagged = checked, flagged
+		chirp.Tags = extractTags(chirp.Body)
+		chirp.Mentions = tx.resolveMentions(chirp.Body)
+		chirp.UpdatedAt = now
+		chirp.EditedAt = &now
+		err = tx.put(bucketChirps, chirp.Id.String(), chirp)
+		if err != nil {
+			return err
+		}
+		result = tx.chirpResponse(chirp, userId)
+		return nil
+	})
+	return result, err
+}
+
+// GetRevisions returns the earlier bodies of a chirp, oldest first
+func (db *DB) GetRevisions(chirpId ID) ([]Revision, error) {
+	result := []Revision{}
+	err := db.View(func(tx *Tx) error {
+		chirp, ok := tx.data.Chirps[chirpId]
+		if !ok {
+			return ErrNotFound
+		}
+		if chirp.hidden() {
+			return ErrGone
+		}
+		for _, id := range tx.data.revisionsByChirp[chirpId] {
+			result = append(result, tx.data.Revisions[id])
+		}
+		return nil
+	})
+	return result, err
+}
+
+// dropRevisions deletes the history of a chirp that is going away
+func (tx *Tx) dropRevisions(chirpId ID) error {
+	for _, id := range idsOf(tx.data.revisionsByChirp, chirpId) {
+		err := tx.del(bucketRevisions, id.String())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// { H{"Authorization: Bearer ${jwtToken}"}, {body} } -> ChirpResponse
+func (db *DB) HandlePutChirpsRequest(w http.ResponseWriter, r *http.Request) {
+	userId, err := db.authenticate(r)
+	if err != nil {
+		log.Print("PutChirps, authenticate:", err.Error())
+		w.WriteHeader(401)
+		return
+	}
+
+	chirpId, err := ParseID(r.PathValue("chirpId"))
+	if err != nil {
+		log.Print("PutChirps, ParseID:", err.Error())
+		w.WriteHeader(400)
+		return
+	}
+
+	var request response
+	err = api.RecieveJson(w, r, &request)
+	if err != nil {
+		log.Print("PutChirps, RecieveJson:", err.Error())
+		w.WriteHeader(400)
+		return
+	}
+
+	chirp, err := db.EditChirp(chirpId, userId, request.Body)
+	if errors.Is(err, errEmptyBody) || errors.Is(err, errChirpTooLong) || errors.Is(err, errBlockedContent) {
+		db.sendJson(w, r, api.JsonErr{ErrorMsg: err.Error()}, 400)
+		return
+	}
+	if errors.Is(err, ErrNotFound) {
+		w.WriteHeader(404)
+		return
+	}
+	if errors.Is(err, ErrGone) {
+		w.WriteHeader(410)
+		return
+	}
+	if errors.Is(err, ErrForbidden) {
+		log.Print("Chirp author mismatch")
+		w.WriteHeader(403)
+		return
+	}
+	if errors.Is(err, errEditWindowClosed) {
+		db.sendJson(w, r, api.JsonErr{ErrorMsg: err.Error()}, 403)
+		return
+	}
+	if err != nil {
+		log.Print("PutChirps, EditChirp:", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	err = db.sendJson(w, r, chirp, 200)
+	if err != nil {
+		log.Print("PutChirps, SendJson:", err.Error())
+	}
+}
+
+// GET /api/chirps/{chirpId}/revisions -> []Revision
+func (db *DB) HandleGetRevisions(w http.ResponseWriter, r *http.Request) {
+	chirpId, err := ParseID(r.PathValue("chirpId"))
+	if err != nil {
+		log.Print("GetRevisions, ParseID:", err.Error())
+		w.WriteHeader(400)
+		return
+	}
+
+	revisions, err := db.GetRevisions(chirpId)
+	if errors.Is(err, ErrNotFound) {
+		w.WriteHeader(404)
+		return
+	}
+	if errors.Is(err, ErrGone) {
+		w.WriteHeader(410)
+		return
+	}
+	if err != nil {
+		log.Print("GetRevisions:", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	err = db.sendJson(w, r, revisions, 200)
+	if err != nil {
+		log.Print("GetRevisions, SendJson:", err.Error())
+	}
+}
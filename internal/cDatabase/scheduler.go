@@ -0,0 +1,99 @@
+package cDatabase
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+)
+
+// RunScheduler publishes scheduled drafts and closes polls as they come due
+// until ctx is cancelled. Both schedules live in storage, so anything that came
+// due while the server was down is handled on the first pass after a restart.
+func (db *DB) RunScheduler(ctx context.Context) {
+	log.Printf("scheduler: running every %s", db.scheduleInterval)
+	ticker := time.NewTicker(db.scheduleInterval)
+	defer ticker.Stop()
+
+	db.runSchedule(time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			log.Print("scheduler: stopped")
+			return
+		case now := <-ticker.C:
+			db.runSchedule(now)
+		}
+	}
+}
+
+func (db *DB) runSchedule(now time.Time) {
+	db.PublishDue(now)
+	closed, err := db.ClosePolls(now)
+	if err != nil {
+		log.Printf("scheduler: closing polls: %s", err.Error())
+	}
+	if closed > 0 {
+		log.Printf("scheduler: closed %d polls", closed)
+	}
+}
+
+// PublishDue publishes every draft scheduled at or before now, oldest schedule first,
+// each in its own transaction. It returns how many chirps were posted.
+func (db *DB) PublishDue(now time.Time) int {
+	var due []Draft
+	db.View(func(tx *Tx) error {
+		for _, draft := range tx.data.Drafts {
+			if draft.PublishAt != nil && !draft.PublishAt.After(now) {
+				due = append(due, draft)
+			}
+		}
+		return nil
+	})
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].PublishAt.Equal(*due[j].PublishAt) {
+			return due[i].PublishAt.Before(*due[j].PublishAt)
+		}
+		return due[i].Id < due[j].Id
+	})
+
+	published := 0
+	for _, draft := range due {
+		posted := false
+		err := db.Update(func(tx *Tx) error {
+			// the author may have edited or cancelled it since
+			draft, ok := tx.data.Drafts[draft.Id]
+			if !ok || draft.PublishAt == nil || draft.PublishAt.After(now) {
+				return nil
+			}
+			// the parent may be gone or the filter reloaded since the draft was saved,
+			// a draft that can't be published stays unscheduled with the reason.
+			// Storage errors surface from Commit instead and leave it to retry.
+			savepoint := tx.savepoint()
+			_, err := tx.publishDraft(draft)
+			if err != nil {
+				rollbackErr := tx.rollbackTo(savepoint)
+				if rollbackErr != nil {
+					return rollbackErr
+				}
+				draft.PublishAt = nil
+				draft.Error = err.Error()
+				draft.UpdatedAt = time.Now().UTC()
+				return tx.put(bucketDrafts, draft.Id.String(), draft)
+			}
+			posted = true
+			return nil
+		})
+		if err != nil {
+			log.Printf("scheduler: draft %v: %s", draft.Id, err.Error())
+			continue
+		}
+		if posted {
+			published++
+		}
+	}
+	if published > 0 {
+		log.Printf("scheduler: published %d chirps", published)
+	}
+	return published
+}
@@ -0,0 +1,61 @@
+package cDatabase
+
+import (
+	"testing"
+	"time"
+)
+
+// TestPublishDueUnschedulesFailures schedules a reply whose parent is then deleted,
+// the scheduler must record why it can't be published instead of retrying forever
+func TestPublishDueUnschedulesFailures(t *testing.T) {
+	db := newTestDB(t, newMemStore())
+	user, err := db.createUser("user@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent, err := db.CreateChirp(NewChirp{Body: "parent", AuthorId: user.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishAt := time.Now().Add(time.Hour)
+	orphan, err := db.CreateDraft(NewDraft{Body: "reply", AuthorId: user.Id, InReplyTo: parent.Id, PublishAt: &publishAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	later, err := db.CreateDraft(NewDraft{Body: "standalone", AuthorId: user.Id, PublishAt: &publishAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.DeleteChirp(parent.Id, user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	published := db.PublishDue(publishAt)
+	if published != 1 {
+		t.Errorf("published %d drafts, want 1", published)
+	}
+
+	draft, err := db.GetDraft(orphan.Id, user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if draft.PublishAt != nil || draft.Error != errBadReply.Error() {
+		t.Errorf("failed draft has publish_at %v and error %q, want unscheduled with %q", draft.PublishAt, draft.Error, errBadReply.Error())
+	}
+	_, err = db.GetDraft(later.Id, user.Id)
+	if err != ErrNotFound {
+		t.Errorf("published draft still there: %v", err)
+	}
+	page, err := db.GetChirps(ChirpQuery{AuthorId: user.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Chirps) != 1 || page.Chirps[0].Body != "standalone" {
+		t.Errorf("chirps after publishing: %v, want only the standalone draft", page.Chirps)
+	}
+	// nothing is left for the next pass
+	if published := db.PublishDue(publishAt.Add(time.Hour)); published != 0 {
+		t.Errorf("second pass published %d drafts, want 0", published)
+	}
+}
@@ -0,0 +1,282 @@
+package cDatabase
+
+import (
+	"errors"
+	"internal/api"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+var errEmptySearch = errors.New("q must contain at least one word")
+
+// SearchQuery is a full-text search over chirp bodies.
+// Text is a list of words that must all appear, "quoted phrases" must appear
+// in order and a trailing * matches any word with that prefix.
+type SearchQuery struct {
+	Text string
+	// AuthorId limits results to one author, 0 for all
+	AuthorId ID
+	// Viewer is the user the results are rendered for, 0 for anonymous
+	Viewer ID
+	// Limit caps the number of results, 0 for defaultChirpLimit
+	Limit int
+}
+
+// SearchResult is a matching chirp and its relevance, higher is better
+type SearchResult struct {
+	ChirpResponse
+	Score float64 `json:"score"`
+}
+
+// searchIndex is an inverted index of chirp bodies, it maps each folded term
+// to the ascending positions it occurs at in each chirp
+type searchIndex struct {
+	postings map[string]map[ID][]int
+	// terms is every key of postings in sorted order, for prefix lookups
+	terms []string
+}
+
+func newSearchIndex() searchIndex {
+	return searchIndex{postings: make(map[string]map[ID][]int)}
+}
+
+func (idx *searchIndex) add(chirp Chirp) {
+	for pos, term := range tokenize(chirp.Body) {
+		docs, ok := idx.postings[term]
+		if !ok {
+			docs = make(map[ID][]int)
+			idx.postings[term] = docs
+			i := sort.SearchStrings(idx.terms, term)
+			idx.terms = append(idx.terms, "")
+			copy(idx.terms[i+1:], idx.terms[i:])
+			idx.terms[i] = term
+		}
+		docs[chirp.Id] = append(docs[chirp.Id], pos)
+	}
+}
+
+func (idx *searchIndex) remove(chirp Chirp) {
+	for _, term := range tokenize(chirp.Body) {
+		docs, ok := idx.postings[term]
+		if !ok {
+			continue
+		}
+		delete(docs, chirp.Id)
+		if len(docs) == 0 {
+			delete(idx.postings, term)
+			i := sort.SearchStrings(idx.terms, term)
+			idx.terms = append(idx.terms[:i], idx.terms[i+1:]...)
+		}
+	}
+}
+
+// withPrefix returns every indexed term starting with prefix
+func (idx *searchIndex) withPrefix(prefix string) []string {
+	i := sort.SearchStrings(idx.terms, prefix)
+	j := i
+	for j < len(idx.terms) && strings.HasPrefix(idx.terms[j], prefix) {
+		j++
+	}
+	return idx.terms[i:j]
+}
+
+// searchClause is one word or quoted phrase of a query,
+// if prefix is set the last term matches as a prefix
+type searchClause struct {
+	terms  []string
+	prefix bool
+}
+
+// hits counts how often c occurs in each chirp
+func (idx *searchIndex) hits(c searchClause) map[ID]int {
+	n := len(c.terms)
+	last := []string{c.terms[n-1]}
+	if c.prefix {
+		last = idx.withPrefix(c.terms[n-1])
+	}
+
+	// positions of the last term, merged across prefix expansions
+	ends := make(map[ID]map[int]bool)
+	for _, term := range last {
+		for id, positions := range idx.postings[term] {
+			if ends[id] == nil {
+				ends[id] = make(map[int]bool)
+			}
+			for _, pos := range positions {
+				ends[id][pos] = true
+			}
+		}
+	}
+
+	result := make(map[ID]int)
+	if n == 1 {
+		for id, positions := range ends {
+			result[id] = len(positions)
+		}
+		return result
+	}
+
+	for id, starts := range idx.postings[c.terms[0]] {
+		if ends[id] == nil {
+			continue
+		}
+		for _, start := range starts {
+			if ends[id][start+n-1] && idx.phraseAt(id, c.terms[1:n-1], start+1) {
+				result[id]++
+			}
+		}
+	}
+	return result
+}
+
+// phraseAt reports whether terms occur in chirp id consecutively from pos
+func (idx *searchIndex) phraseAt(id ID, terms []string, pos int) bool {
+	for i, term := range terms {
+		positions := idx.postings[term][id]
+		j := sort.SearchInts(positions, pos+i)
+		if j == len(positions) || positions[j] != pos+i {
+			return false
+		}
+	}
+	return true
+}
+
+// tokenize splits s into lowercase words with accents stripped,
+// so "Café" and "CAFE" index the same
+func tokenize(s string) []string {
+	// transformers keep state, build a fresh chain per call
+	fold := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), cases.Fold(), norm.NFC)
+	folded, _, err := transform.String(fold, s)
+	if err != nil {
+		folded = strings.ToLower(s)
+	}
+	return strings.FieldsFunc(folded, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// parseSearch splits text into clauses, words inside double quotes form one phrase
+func parseSearch(text string) []searchClause {
+	var result []searchClause
+	add := func(s string) {
+		terms := tokenize(s)
+		if len(terms) == 0 {
+			return
+		}
+		result = append(result, searchClause{terms: terms, prefix: strings.HasSuffix(s, "*")})
+	}
+
+	for i, part := range strings.Split(text, `"`) {
+		if i%2 == 1 {
+			add(part)
+			continue
+		}
+		for _, word := range strings.Fields(part) {
+			add(word)
+		}
+	}
+	return result
+}
+
+// SearchChirps returns the chirps matching every clause of q, most relevant first.
+// Each clause scores by how often it occurs, weighted by how rare it is and how many words it spans.
+func (db *DB) SearchChirps(q SearchQuery) ([]SearchResult, error) {
+	clauses := parseSearch(q.Text)
+	if len(clauses) == 0 {
+		return nil, errEmptySearch
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultChirpLimit
+	}
+
+	result := []SearchResult{}
+	err := db.View(func(tx *Tx) error {
+		total := float64(len(tx.data.Chirps))
+		scores := make(map[ID]float64)
+		for i, c := range clauses {
+			hits := tx.data.search.hits(c)
+			idf := math.Log(1 + total/float64(len(hits)+1))
+			// every clause must match, so later clauses only narrow the first one's hits
+			for id, tf := range hits {
+				if _, ok := scores[id]; ok || i == 0 {
+					scores[id] += (1 + math.Log(float64(tf))) * idf * float64(len(c.terms))
+				}
+			}
+			for id := range scores {
+				if hits[id] == 0 {
+					delete(scores, id)
+				}
+			}
+		}
+
+		for id, score := range scores {
+			chirp := tx.data.Chirps[id]
+			if q.AuthorId != 0 && chirp.AuthorId != q.AuthorId {
+				continue
+			}
+			result = append(result, SearchResult{ChirpResponse: tx.chirpResponse(chirp, q.Viewer), Score: score})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// ties go to the newest chirp
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Score != result[j].Score {
+			return result[i].Score > result[j].Score
+		}
+		return result[i].Id > result[j].Id
+	})
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+// GET /api/chirps/search?q=&author_id=&limit= -> []SearchResult
+func (db *DB) HandleSearchChirps(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := SearchQuery{Text: query.Get("q"), Viewer: db.viewerId(r)}
+	var err error
+
+	if s := query.Get("author_id"); s != "" {
+		q.AuthorId, err = ParseID(s)
+		if err != nil {
+			db.sendJson(w, r, api.JsonErr{ErrorMsg: "author_id must be a chirpy id"}, 400)
+			return
+		}
+	}
+	q.Limit, err = parseLimit(query)
+	if err != nil {
+		db.sendJson(w, r, api.JsonErr{ErrorMsg: err.Error()}, 400)
+		return
+	}
+
+	results, err := db.SearchChirps(q)
+	if errors.Is(err, errEmptySearch) {
+		db.sendJson(w, r, api.JsonErr{ErrorMsg: err.Error()}, 400)
+		return
+	}
+	if err != nil {
+		log.Print("SearchChirps:", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	err = db.sendJson(w, r, results, 200)
+	if err != nil {
+		log.Print("SearchChirps, SendJson:", err.Error())
+	}
+}
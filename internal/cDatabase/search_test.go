@@ -0,0 +1,86 @@
+package cDatabase
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []string
+	}{
+		{"Café CAFE cafe", []string{"cafe", "cafe", "cafe"}},
+		{"cafe\u0301 decomposed", []string{"cafe", "decomposed"}},
+		{"naïve-résumé, ÅNGSTRÖM!", []string{"naive", "resume", "angstrom"}},
+		{"Straße STRASSE", []string{"strasse", "strasse"}},
+		{"ΣΊΣΥΦΟΣ σίσυφος", []string{"σισυφοσ", "σισυφοσ"}},
+		{"@user #tag 42nd", []string{"user", "tag", "42nd"}},
+		{"日本語 テキスト", []string{"日本語", "テキスト"}},
+		{" \t!? ", nil},
+	} {
+		got := tokenize(tc.in)
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("tokenize(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+// TestSearchRanking checks folding on both sides of the search, phrases and prefixes,
+// and that chirps rank by how often they match with ties going to the newest
+func TestSearchRanking(t *testing.T) {
+	db := newTestDB(t, newMemStore())
+	user, err := db.createUser("user@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]ID)
+	for _, c := range []struct{ name, body string }{
+		{"culture", "Café culture"},
+		{"repeated", "CAFE cafe café"},
+		{"closed", "the cafe is closed"},
+		{"coffee", "coffee elsewhere"},
+		{"street", "Straße und Caféteria"},
+	} {
+		chirp, err := db.CreateChirp(NewChirp{Body: c.body, AuthorId: user.Id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[c.name] = chirp.Id
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{"CAFÉ", []string{"repeated", "closed", "culture"}},
+		{`"cafe culture"`, []string{"culture"}},
+		{`"culture cafe"`, nil},
+		{"caf*", []string{"repeated", "street", "closed", "culture"}},
+		{"cafe closed", []string{"closed"}},
+		{"strasse", []string{"street"}},
+		{"STRAẞE", []string{"street"}},
+		{"tea", nil},
+	} {
+		results, err := db.SearchChirps(SearchQuery{Text: tc.query})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []ID
+		for _, result := range results {
+			got = append(got, result.Id)
+		}
+		var want []ID
+		for _, name := range tc.want {
+			want = append(want, ids[name])
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("search %q = %v, want %v (%v)", tc.query, got, want, tc.want)
+		}
+	}
+
+	_, err = db.SearchChirps(SearchQuery{Text: `"" !?`})
+	if err != errEmptySearch {
+		t.Errorf("search without words: got %v, want errEmptySearch", err)
+	}
+}
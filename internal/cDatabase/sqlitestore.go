@@ -0,0 +1,237 @@
+package cDatabase
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema stores every bucket in one key/value table,
+// records are the same JSON documents the file store keeps.
+// meta holds the scalar fields of DBStructure such as schema_version.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS records (
+	bucket TEXT NOT NULL,
+	key    TEXT NOT NULL,
+	value  TEXT NOT NULL,
+	PRIMARY KEY (bucket, key)
+);
+CREATE TABLE IF NOT EXISTS meta (
+	key   TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);`
+
+// sqliteStore keeps the dataset in an embedded SQLite database.
+// It is a persistence format like the JSON file, not a queried backend:
+// Load reads every record into memory and DB serves reads from there.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// openSQLiteStore opens the SQLite database at path, creating it if it doesn't exist.
+// If reset is true an existing database is wiped first, meant for dev only
+func openSQLiteStore(path string, reset bool) (*sqliteStore, error) {
+	if reset {
+		log.Printf("resetDB: removing %s", path)
+		for _, p := range []string{path, path + "-wal", path + "-shm"} {
+			err := os.Remove(p)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+		}
+	}
+
+	// SQLite creates its files world readable and they hold password hashes and refresh tokens.
+	// It gives -wal and -shm the mode of the main file, so that one is created up front.
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	for _, p := range []string{path, path + "-wal", path + "-shm"} {
+		err = os.Chmod(p, 0600)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	db, err := sql.Open("sqlite", path+"?_pragma=journal_mode(WAL)&_pragma=synchronous(FULL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// a single connection serialises writers, SQLite allows only one at a time anyway
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(sqliteSchema)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlite schema: %w", err)
+	}
+	ss := &sqliteStore{db: db}
+
+	err = ss.migrate()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return ss, nil
+}
+
+// migrate rewrites the database at the current schema version if it is behind
+func (ss *sqliteStore) migrate() error {
+	dat, err := ss.document()
+	if err != nil {
+		return err
+	}
+	if dat == nil {
+		_, err = ss.db.Exec("INSERT INTO meta (key, value) VALUES ('schema_version', ?)", strconv.Itoa(currentSchemaVersion))
+		return err
+	}
+	dat, reports, err := migrateDocument(dat)
+	if err != nil {
+		return err
+	}
+	if len(reports) == 0 {
+		return nil
+	}
+	for _, report := range reports {
+		log.Printf("sqlite: migrated v%d -> v%d: %s %v", report.From, report.To, report.Description, report.Changes)
+	}
+
+	dbStruct, err := decodeDB(dat)
+	if err != nil {
+		return err
+	}
+	return ss.Snapshot(dbStruct)
+}
+
+// document assembles every record into the same JSON document the file store keeps
+func (ss *sqliteStore) document() ([]byte, error) {
+	doc := make(map[string]interface{})
+
+	rows, err := ss.db.Query("SELECT key, value FROM meta")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var key, value string
+		err = rows.Scan(&key, &value)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		doc[key] = json.RawMessage(value)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	rows, err = ss.db.Query("SELECT bucket, key, value FROM records")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bucket, key, value string
+		err = rows.Scan(&bucket, &key, &value)
+		if err != nil {
+			return nil, err
+		}
+		records, ok := doc[bucket].(map[string]json.RawMessage)
+		if !ok {
+			records = make(map[string]json.RawMessage)
+			doc[bucket] = records
+		}
+		records[key] = json.RawMessage(value)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	// a brand new database starts at the current version
+	if len(doc) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(doc)
+}
+
+func (ss *sqliteStore) Load() (DBStructure, error) {
+	dat, err := ss.document()
+	if err != nil {
+		return DBStructure{}, err
+	}
+	return decodeDB(dat)
+}
+
+// Commit applies changes in a single SQLite transaction
+func (ss *sqliteStore) Commit(changes []change) error {
+	tx, err := ss.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = execChanges(tx, changes)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Snapshot deletes every record and writes dbStruct in its place, in one transaction
+func (ss *sqliteStore) Snapshot(dbStruct DBStructure) error {
+	changes, err := dbStruct.records()
+	if err != nil {
+		return err
+	}
+
+	tx, err := ss.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM records")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT OR REPLACE INTO meta (key, value) VALUES ('schema_version', ?)", strconv.Itoa(dbStruct.SchemaVersion))
+	if err != nil {
+		return err
+	}
+	err = execChanges(tx, changes)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (ss *sqliteStore) Close() error {
+	return ss.db.Close()
+}
+
+func execChanges(tx *sql.Tx, changes []change) error {
+	for _, c := range changes {
+		var err error
+		switch c.Op {
+		case opPut:
+			_, err = tx.Exec("INSERT OR REPLACE INTO records (bucket, key, value) VALUES (?, ?, ?)", c.Bucket, c.Key, string(c.Value))
+		case opDelete:
+			_, err = tx.Exec("DELETE FROM records WHERE bucket = ? AND key = ?", c.Bucket, c.Key)
+		default:
+			err = fmt.Errorf("unknown op %q", c.Op)
+		}
+		if err != nil {
+			return fmt.Errorf("sqlite %s %s/%s: %w", c.Op, c.Bucket, c.Key, err)
+		}
+	}
+	return nil
+}
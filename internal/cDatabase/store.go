@@ -0,0 +1,266 @@
+package cDatabase
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Store is the persistence backend behind DB.
+// Data is organised in buckets (chirps, users, r_tokens, webhook_events, sequences, likes, rechirps, follows, revisions, drafts, votes, collections, bookmarks)
+// of JSON records, every mutation reaches the store as a batch of changes.
+//
+// A Store only persists records, it is never queried: DB loads the whole dataset
+// into memory on startup and serves every read from there. Every backend,
+// SQLite included, is a durable format for that in-memory copy rather than
+// a database the app queries, so the dataset has to fit in memory.
+type Store interface {
+	// Load returns the full dataset
+	Load() (DBStructure, error)
+	// Commit durably applies a batch of changes, all or nothing
+	Commit(changes []change) error
+	// Snapshot replaces everything in the store with dbStruct
+	Snapshot(dbStruct DBStructure) error
+	// Close flushes and releases the store
+	Close() error
+}
+
+// OpenStore opens the backend named in cfg.Backend
+func OpenStore(cfg Config) (Store, error) {
+	switch cfg.Backend {
+	case "", BackendJSON:
+		keys, err := newKeyring(cfg.EncryptionKey, cfg.PreviousEncryptionKeys)
+		if err != nil {
+			return nil, err
+		}
+		return openFileStore(cfg.Path, cfg.Reset, keys)
+	case BackendMemory:
+		return newMemStore(), nil
+	case BackendSQLite:
+		// SQLite has no encryption of its own, starting without it would leave the data in the clear
+		if cfg.EncryptionKey != "" || len(cfg.PreviousEncryptionKeys) > 0 {
+			return nil, errors.New("database encryption keys are not supported by the sqlite backend")
+		}
+		return openSQLiteStore(cfg.Path, cfg.Reset)
+	}
+	return nil, fmt.Errorf("unknown database backend %q", cfg.Backend)
+}
+
+const (
+	opPut    = "put"
+	opDelete = "delete"
+)
+
+const (
+	bucketChirps        = "chirps"
+	bucketUsers         = "users"
+	bucketRTokens       = "r_tokens"
+	bucketWebhookEvents = "webhook_events"
+	bucketSequences     = "sequences"
+	bucketLikes         = "likes"
+	bucketRechirps      = "rechirps"
+	bucketFollows       = "follows"
+	bucketRevisions     = "revisions"
+	bucketDrafts        = "drafts"
+	bucketVotes         = "votes"
+	bucketCollections   = "collections"
+	bucketBookmarks     = "bookmarks"
+)
+
+// change is a single mutation of one record
+type change struct {
+	Op     string          `json:"op"`
+	Bucket string          `json:"bucket"`
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value,omitempty"`
+}
+
+// putChange stores v under key in bucket
+func putChange(bucket, key string, v interface{}) (change, error) {
+	dat, err := json.Marshal(v)
+	if err != nil {
+		return change{}, err
+	}
+	return change{Op: opPut, Bucket: bucket, Key: key, Value: dat}, nil
+}
+
+// deleteChange removes key from bucket
+func deleteChange(bucket, key string) change {
+	return change{Op: opDelete, Bucket: bucket, Key: key}
+}
+
+// apply replays a single change on top of dbStruct,
+// put and delete are idempotent so replaying twice is harmless
+func (dbStruct *DBStructure) apply(c change) error {
+	switch c.Bucket {
+	case bucketChirps:
+		return applyChange(dbStruct.Chirps, c, ParseID)
+	case bucketUsers:
+		return applyChange(dbStruct.Users, c, ParseID)
+	case bucketRTokens:
+		return applyChange(dbStruct.RTokens, c, parseStringKey)
+	case bucketWebhookEvents:
+		return applyChange(dbStruct.WebhookEvents, c, ParseID)
+	case bucketSequences:
+		return applyChange(dbStruct.Sequences, c, parseStringKey)
+	case bucketLikes:
+		return applyChange(dbStruct.Likes, c, parseStringKey)
+	case bucketRechirps:
+		return applyChange(dbStruct.Rechirps, c, parseStringKey)
+	case bucketFollows:
+		return applyChange(dbStruct.Follows, c, parseStringKey)
+	case bucketRevisions:
+		return applyChange(dbStruct.Revisions, c, ParseID)
+	case bucketDrafts:
+		return applyChange(dbStruct.Drafts, c, ParseID)
+	case bucketVotes:
+		return applyChange(dbStruct.Votes, c, parseStringKey)
+	case bucketCollections:
+		return applyChange(dbStruct.Collections, c, ParseID)
+	case bucketBookmarks:
+		return applyChange(dbStruct.Bookmarks, c, parseStringKey)
+	}
+	return fmt.Errorf("apply: unknown bucket %q", c.Bucket)
+}
+
+// inverse returns the change that undoes c on dbStruct as it is now,
+// a put of the current record or a delete if there is none
+func (dbStruct *DBStructure) inverse(c change) (change, error) {
+	switch c.Bucket {
+	case bucketChirps:
+		return inverseChange(dbStruct.Chirps, c, ParseID)
+	case bucketUsers:
+		return inverseChange(dbStruct.Users, c, ParseID)
+	case bucketRTokens:
+		return inverseChange(dbStruct.RTokens, c, parseStringKey)
+	case bucketWebhookEvents:
+		return inverseChange(dbStruct.WebhookEvents, c, ParseID)
+	case bucketSequences:
+		return inverseChange(dbStruct.Sequences, c, parseStringKey)
+	case bucketLikes:
+		return inverseChange(dbStruct.Likes, c, parseStringKey)
+	case bucketRechirps:
+		return inverseChange(dbStruct.Rechirps, c, parseStringKey)
+	case bucketFollows:
+		return inverseChange(dbStruct.Follows, c, parseStringKey)
+	case bucketRevisions:
+		return inverseChange(dbStruct.Revisions, c, ParseID)
+	case bucketDrafts:
+		return inverseChange(dbStruct.Drafts, c, ParseID)
+	case bucketVotes:
+		return inverseChange(dbStruct.Votes, c, parseStringKey)
+	case bucketCollections:
+		return inverseChange(dbStruct.Collections, c, ParseID)
+	case bucketBookmarks:
+		return inverseChange(dbStruct.Bookmarks, c, parseStringKey)
+	}
+	return change{}, fmt.Errorf("inverse: unknown bucket %q", c.Bucket)
+}
+
+// records lists every record in dbStruct as a put change
+func (dbStruct *DBStructure) records() ([]change, error) {
+	var result []change
+	var err error
+	result, err = appendRecords(result, bucketChirps, dbStruct.Chirps, ID.String)
+	if err != nil {
+		return nil, err
+	}
+	result, err = appendRecords(result, bucketUsers, dbStruct.Users, ID.String)
+	if err != nil {
+		return nil, err
+	}
+	result, err = appendRecords(result, bucketRTokens, dbStruct.RTokens, formatStringKey)
+	if err != nil {
+		return nil, err
+	}
+	result, err = appendRecords(result, bucketWebhookEvents, dbStruct.WebhookEvents, ID.String)
+	if err != nil {
+		return nil, err
+	}
+	result, err = appendRecords(result, bucketSequences, dbStruct.Sequences, formatStringKey)
+	if err != nil {
+		return nil, err
+	}
+	result, err = appendRecords(result, bucketLikes, dbStruct.Likes, formatStringKey)
+	if err != nil {
+		return nil, err
+	}
+	result, err = appendRecords(result, bucketRechirps, dbStruct.Rechirps, formatStringKey)
+	if err != nil {
+		return nil, err
+	}
+	result, err = appendRecords(result, bucketFollows, dbStruct.Follows, formatStringKey)
+	if err != nil {
+		return nil, err
+	}
+	result, err = appendRecords(result, bucketRevisions, dbStruct.Revisions, ID.String)
+	if err != nil {
+		return nil, err
+	}
+	result, err = appendRecords(result, bucketDrafts, dbStruct.Drafts, ID.String)
+	if err != nil {
+		return nil, err
+	}
+	result, err = appendRecords(result, bucketVotes, dbStruct.Votes, formatStringKey)
+	if err != nil {
+		return nil, err
+	}
+	result, err = appendRecords(result, bucketCollections, dbStruct.Collections, ID.String)
+	if err != nil {
+		return nil, err
+	}
+	result, err = appendRecords(result, bucketBookmarks, dbStruct.Bookmarks, formatStringKey)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func parseStringKey(s string) (string, error) { return s, nil }
+
+func formatStringKey(s string) string { return s }
+
+func applyChange[K comparable, V any](m map[K]V, c change, parseKey func(string) (K, error)) error {
+	key, err := parseKey(c.Key)
+	if err != nil {
+		return fmt.Errorf("apply %s key %q: %w", c.Bucket, c.Key, err)
+	}
+
+	switch c.Op {
+	case opPut:
+		var v V
+		err = json.Unmarshal(c.Value, &v)
+		if err != nil {
+			return fmt.Errorf("apply %s key %q: %w", c.Bucket, c.Key, err)
+		}
+		m[key] = v
+	case opDelete:
+		delete(m, key)
+	default:
+		return fmt.Errorf("apply: unknown op %q", c.Op)
+	}
+	return nil
+}
+
+func inverseChange[K comparable, V any](m map[K]V, c change, parseKey func(string) (K, error)) (change, error) {
+	key, err := parseKey(c.Key)
+	if err != nil {
+		return change{}, fmt.Errorf("inverse %s key %q: %w", c.Bucket, c.Key, err)
+	}
+	v, ok := m[key]
+	if !ok {
+		return deleteChange(c.Bucket, c.Key), nil
+	}
+	return putChange(c.Bucket, c.Key, v)
+}
+
+func appendRecords[K comparable, V any](result []change, bucket string, m map[K]V, formatKey func(K) string) ([]change, error) {
+	for key, v := range m {
+		c, err := putChange(bucket, formatKey(key), v)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, c)
+	}
+	return result, nil
+}
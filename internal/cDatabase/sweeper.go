@@ -0,0 +1,165 @@
+package cDatabase
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SweepStats counts what the background sweeper has purged
+type SweepStats struct {
+	Runs    int       `json:"runs"`
+	Errors  int       `json:"errors"`
+	LastRun time.Time `json:"last_run"`
+	// LastPurged and TotalPurged are keyed by sweep task name
+	LastPurged  map[string]int `json:"last_purged"`
+	TotalPurged map[string]int `json:"total_purged"`
+}
+
+// sweeper holds the stats of RunSweeper, guarded separately from db.mux
+// so reading them never waits on a write transaction
+type sweeper struct {
+	mux   sync.Mutex
+	stats SweepStats
+}
+
+// sweepTask deletes stale records of one kind and returns how many it removed
+type sweepTask struct {
+	name string
+	run  func(tx *Tx, now time.Time) (int, error)
+}
+
+// sweepTasks lists everything the sweeper purges on each run
+func (db *DB) sweepTasks() []sweepTask {
+	return []sweepTask{
+		{name: "expired_refresh_tokens", run: sweepRefreshTokens},
+		{name: "webhook_events", run: func(tx *Tx, now time.Time) (int, error) {
+			return sweepWebhookEvents(tx, now.Add(-db.webhookRetention))
+		}},
+		{name: "trashed_chirps", run: func(tx *Tx, now time.Time) (int, error) {
+			return sweepTrash(tx, now.Add(-db.trashRetention))
+		}},
+	}
+}
+
+// RunSweeper purges stale data every sweep interval until ctx is cancelled
+func (db *DB) RunSweeper(ctx context.Context) {
+	log.Printf("sweeper: running every %s", db.sweepInterval)
+	ticker := time.NewTicker(db.sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Print("sweeper: stopped")
+			return
+		case now := <-ticker.C:
+			db.Sweep(now)
+		}
+	}
+}
+
+// Sweep runs every sweep task once, each in its own transaction
+func (db *DB) Sweep(now time.Time) SweepStats {
+	purged := make(map[string]int)
+	failed := 0
+	for _, task := range db.sweepTasks() {
+		var n int
+		err := db.Update(func(tx *Tx) error {
+			var err error
+			n, err = task.run(tx, now)
+			return err
+		})
+		if err != nil {
+			log.Printf("sweeper: %s: %s", task.name, err.Error())
+			failed++
+			continue
+		}
+		purged[task.name] = n
+		if n > 0 {
+			log.Printf("sweeper: purged %d %s", n, task.name)
+		}
+	}
+
+	db.sweeper.mux.Lock()
+	defer db.sweeper.mux.Unlock()
+	stats := &db.sweeper.stats
+	if stats.TotalPurged == nil {
+		stats.TotalPurged = make(map[string]int)
+	}
+	stats.Runs++
+	stats.Errors += failed
+	stats.LastRun = now
+	stats.LastPurged = purged
+	for name, n := range purged {
+		stats.TotalPurged[name] += n
+	}
+	return db.sweepStatsLocked()
+}
+
+// SweepStats returns a copy of the sweeper counters
+func (db *DB) SweepStats() SweepStats {
+	db.sweeper.mux.Lock()
+	defer db.sweeper.mux.Unlock()
+	return db.sweepStatsLocked()
+}
+
+func (db *DB) sweepStatsLocked() SweepStats {
+	result := db.sweeper.stats
+	result.LastPurged = make(map[string]int)
+	for name, n := range db.sweeper.stats.LastPurged {
+		result.LastPurged[name] = n
+	}
+	result.TotalPurged = make(map[string]int)
+	for name, n := range db.sweeper.stats.TotalPurged {
+		result.TotalPurged[name] = n
+	}
+	return result
+}
+
+func sweepRefreshTokens(tx *Tx, now time.Time) (int, error) {
+	var expired []string
+	for token, rToken := range tx.data.RTokens {
+		if rToken.ExpireAt.Before(now) {
+			expired = append(expired, token)
+		}
+	}
+	for _, token := range expired {
+		err := tx.del(bucketRTokens, token)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), nil
+}
+
+func sweepWebhookEvents(tx *Tx, cutoff time.Time) (int, error) {
+	var stale []ID
+	for id, event := range tx.data.WebhookEvents {
+		if event.ReceivedAt.Before(cutoff) {
+			stale = append(stale, id)
+		}
+	}
+	for _, id := range stale {
+		err := tx.del(bucketWebhookEvents, id.String())
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(stale), nil
+}
+
+// GET /admin/sweeper -> SweepStats
+func (db *DB) HandleGetSweeper(w http.ResponseWriter, r *http.Request) {
+	if !db.isAdmin(r) {
+		w.WriteHeader(401)
+		return
+	}
+
+	err := db.sendJson(w, r, db.SweepStats(), 200)
+	if err != nil {
+		log.Print("GetSweeper, SendJson:", err.Error())
+	}
+}
@@ -0,0 +1,144 @@
+package cDatabase
+
+import (
+	"internal/api"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var (
+	// a # or @ only starts a tag or mention at the start of a word,
+	// so "a#b" and "me@example.com" are left alone
+	tagPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_&#@])#([\p{L}\p{N}_]+)`)
+	// mentionPattern is the @email form clients may type, it is rewritten to
+	// idMentionPattern, "@42", before a chirp is stored
+	mentionPattern   = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_@])@([^\s@]+@[^\s@]+)`)
+	idMentionPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_@])@([0-9]+)\b`)
+)
+
+// extractTags returns the distinct #tags in body, lowercased, in order of appearance
+func extractTags(body string) []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, match := range tagPattern.FindAllStringSubmatch(body, -1) {
+		tag := strings.ToLower(match[1])
+		if !seen[tag] {
+			seen[tag] = true
+			result = append(result, tag)
+		}
+	}
+	return result
+}
+
+// extractMentions returns the distinct emails @mentioned in body, e.g. "@walt@example.com".
+// Only migrations still see this form, stored chirps mention users by id.
+func extractMentions(body string) []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(body, -1) {
+		email := strings.TrimRight(match[1], ".,;:!?)'\"")
+		if !seen[email] {
+			seen[email] = true
+			result = append(result, email)
+		}
+	}
+	return result
+}
+
+// rewriteMentions replaces each @email mention of a known user with @id,
+// so a public chirp never shows the address its author typed
+func (tx *Tx) rewriteMentions(body string) string {
+	return replaceEmailMentions(body, func(email string) (ID, bool) {
+		user, ok := tx.userByEmail(email)
+		return user.Id, ok
+	})
+}
+
+// replaceEmailMentions replaces each @email in body that idOf knows with @id,
+// unknown emails are left as they are
+func replaceEmailMentions(body string, idOf func(email string) (ID, bool)) string {
+	var b strings.Builder
+	last := 0
+	for _, match := range mentionPattern.FindAllStringSubmatchIndex(body, -1) {
+		start := match[2]
+		email := strings.TrimRight(body[start:match[3]], ".,;:!?)'\"")
+		id, ok := idOf(email)
+		if !ok {
+			continue
+		}
+		b.WriteString(body[last:start])
+		b.WriteString(id.String())
+		last = start + len(email)
+	}
+	b.WriteString(body[last:])
+	return b.String()
+}
+
+// resolveMentions returns the distinct users @mentioned by id in body, in order of appearance.
+// Ids that name no user are dropped.
+func (tx *Tx) resolveMentions(body string) []ID {
+	var result []ID
+	seen := make(map[ID]bool)
+	for _, match := range idMentionPattern.FindAllStringSubmatch(body, -1) {
+		id, err := ParseID(match[1])
+		if err != nil || seen[id] {
+			continue
+		}
+		if _, ok := tx.data.Users[id]; ok {
+			seen[id] = true
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// normalizeTag lowercases tag and strips a leading #
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimPrefix(tag, "#"))
+}
+
+// GET /api/tags/{tag}/chirps -> []Chirp, takes the same query parameters as GET /api/chirps
+func (db *DB) HandleGetTagChirps(w http.ResponseWriter, r *http.Request) {
+	q, err := parseChirpQuery(r)
+	if err != nil {
+		db.sendJson(w, r, api.JsonErr{ErrorMsg: err.Error()}, 400)
+		return
+	}
+	q.Tag = normalizeTag(r.PathValue("tag"))
+	if q.Tag == "" {
+		db.sendJson(w, r, api.JsonErr{ErrorMsg: "tag must not be empty"}, 400)
+		return
+	}
+
+	db.serveChirps(w, r, q)
+}
+
+// GET /api/users/{id}/mentions -> []Chirp, takes the same query parameters as GET /api/chirps
+func (db *DB) HandleGetUserMentions(w http.ResponseWriter, r *http.Request) {
+	q, err := parseChirpQuery(r)
+	if err != nil {
+		db.sendJson(w, r, api.JsonErr{ErrorMsg: err.Error()}, 400)
+		return
+	}
+	q.MentionId, err = ParseID(r.PathValue("id"))
+	if err != nil {
+		log.Print("GetUserMentions, ParseID:", err.Error())
+		w.WriteHeader(400)
+		return
+	}
+
+	err = db.View(func(tx *Tx) error {
+		if _, ok := tx.data.Users[q.MentionId]; !ok {
+			return ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	db.serveChirps(w, r, q)
+}
@@ -0,0 +1,163 @@
+package cDatabase
+
+import (
+	"errors"
+	"fmt"
+	"internal/api"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Reply tree depth for GET /api/chirps/{chirpId}/thread
+const (
+	defaultThreadDepth = 3
+	maxThreadDepth     = 10
+)
+
+// Thread is a chirp in the context of its conversation.
+// Deleted chirps appear as tombstones with "deleted": true and no body or author.
+type Thread struct {
+	// Ancestors runs from the conversation root down to the chirp's parent
+	Ancestors []ChirpResponse `json:"ancestors"`
+	Chirp     ThreadNode      `json:"chirp"`
+	// NextCursor pages through the chirp's direct replies, empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// ThreadNode is a chirp with its replies, oldest first.
+// ReplyCount counts every direct reply, Replies may hold fewer when the tree is cut
+// off by depth or page size; fetch the node's own thread to see the rest.
+type ThreadNode struct {
+	ChirpResponse
+	ReplyCount int          `json:"reply_count"`
+	Replies    []ThreadNode `json:"replies"`
+}
+
+// ThreadQuery picks the part of a reply tree GetThread returns
+type ThreadQuery struct {
+	ChirpId ID
+	// Depth is how many levels of replies to include below the chirp
+	Depth int
+	// Limit caps the replies listed under any one chirp,
+	// Cursor continues the chirp's direct replies from a Thread.NextCursor
+	Limit  int
+	Cursor string
+	// Viewer is the user the thread is rendered for, 0 for anonymous
+	Viewer ID
+}
+
+// GetThread returns the chirp in q with its ancestors and a page of its reply tree
+func (db *DB) GetThread(q ThreadQuery) (Thread, error) {
+	after, err := decodeChirpCursor(q.Cursor)
+	if err != nil {
+		return Thread{}, err
+	}
+	if after != nil && (after.SortBy != SortById || after.Desc) {
+		return Thread{}, errBadCursor
+	}
+
+	var result Thread
+	err = db.View(func(tx *Tx) error {
+		chirp, ok := tx.data.Chirps[q.ChirpId]
+		if !ok {
+			return ErrNotFound
+		}
+
+		result.Ancestors = []ChirpResponse{}
+		for parentId := chirp.InReplyTo; parentId != 0; {
+			parent := tx.data.Chirps[parentId]
+			result.Ancestors = append(result.Ancestors, tx.chirpResponse(parent, q.Viewer))
+			parentId = parent.InReplyTo
+		}
+		for i, j := 0, len(result.Ancestors)-1; i < j; i, j = i+1, j-1 {
+			result.Ancestors[i], result.Ancestors[j] = result.Ancestors[j], result.Ancestors[i]
+		}
+
+		replies := tx.data.repliesTo[chirp.Id]
+		if after != nil {
+			replies = replies[sort.Search(len(replies), func(i int) bool { return replies[i] > after.Id }):]
+		}
+		if len(replies) > q.Limit {
+			replies = replies[:q.Limit]
+			last := tx.data.Chirps[replies[q.Limit-1]]
+			result.NextCursor = encodeChirpCursor(chirpCursor{SortBy: SortById, Id: last.Id, CreatedAt: last.CreatedAt})
+		}
+
+		result.Chirp = ThreadNode{
+			ChirpResponse: tx.chirpResponse(chirp, q.Viewer),
+			ReplyCount:    len(tx.data.repliesTo[chirp.Id]),
+			Replies:       q.replyNodes(tx, replies, 1),
+		}
+		return nil
+	})
+	return result, err
+}
+
+// replyNodes builds the subtrees below ids, depth is the level ids sit at
+func (q ThreadQuery) replyNodes(tx *Tx, ids []ID, depth int) []ThreadNode {
+	result := []ThreadNode{}
+	if depth > q.Depth {
+		return result
+	}
+	for _, id := range ids {
+		replies := tx.data.repliesTo[id]
+		node := ThreadNode{ChirpResponse: tx.chirpResponse(tx.data.Chirps[id], q.Viewer), ReplyCount: len(replies)}
+		if len(replies) > q.Limit {
+			replies = replies[:q.Limit]
+		}
+		node.Replies = q.replyNodes(tx, replies, depth+1)
+		result = append(result, node)
+	}
+	return result
+}
+
+// GET /api/chirps/{chirpId}/thread?depth=&limit=&cursor= -> Thread
+func (db *DB) HandleGetThread(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := ThreadQuery{Depth: defaultThreadDepth, Limit: defaultChirpLimit, Cursor: query.Get("cursor"), Viewer: db.viewerId(r)}
+	var err error
+
+	q.ChirpId, err = ParseID(r.PathValue("chirpId"))
+	if err != nil {
+		log.Print("GetThread, ParseID:", err.Error())
+		w.WriteHeader(400)
+		return
+	}
+	if s := query.Get("depth"); s != "" {
+		q.Depth, err = strconv.Atoi(s)
+		if err != nil || q.Depth < 0 || q.Depth > maxThreadDepth {
+			db.sendJson(w, r, api.JsonErr{ErrorMsg: fmt.Sprintf("depth must be between 0 and %d", maxThreadDepth)}, 400)
+			return
+		}
+	}
+	limit, err := parseLimit(query)
+	if err != nil {
+		db.sendJson(w, r, api.JsonErr{ErrorMsg: err.Error()}, 400)
+		return
+	}
+	if limit != 0 {
+		q.Limit = limit
+	}
+
+	thread, err := db.GetThread(q)
+	if errors.Is(err, errBadCursor) {
+		db.sendJson(w, r, api.JsonErr{ErrorMsg: err.Error()}, 400)
+		return
+	}
+	if errors.Is(err, ErrNotFound) {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		log.Print("GetThread:", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	err = db.sendJson(w, r, thread, 200)
+	if err != nil {
+		log.Print("GetThread, SendJson:", err.Error())
+	}
+}
@@ -0,0 +1,185 @@
+package cDatabase
+
+import (
+	"errors"
+	"internal/api"
+	"log"
+	"net/http"
+	"time"
+)
+
+// TrashedChirp is a deleted chirp as its author sees it in the trash,
+// PurgeAt is when the sweeper removes it for good
+type TrashedChirp struct {
+	ChirpResponse
+	PurgeAt time.Time `json:"purge_at"`
+}
+
+var errRestoreWindowClosed = errors.New("the restore window for this chirp has closed")
+
+// RestoreChirp takes a chirp back out of the trash, userId must be its author.
+// Restoring a chirp that was never deleted is a no-op.
+func (db *DB) RestoreChirp(chirpId, userId ID) (ChirpResponse, error) {
+	var result ChirpResponse
+	err := db.Update(func(tx *Tx) error {
+		chirp, ok := tx.data.Chirps[chirpId]
+		if !ok {
+			return ErrNotFound
+		}
+		if chirp.Deleted {
+			return ErrGone
+		}
+		if chirp.AuthorId != userId {
+			return ErrForbidden
+		}
+		if chirp.DeletedAt != nil {
+			if time.Since(*chirp.DeletedAt) > db.trashRetention {
+				return errRestoreWindowClosed
+			}
+			chirp.DeletedAt = nil
+			err := tx.put(bucketChirps, chirp.Id.String(), chirp)
+			if err != nil {
+				return err
+			}
+		}
+		result = tx.chirpResponse(chirp, userId)
+		return nil
+	})
+	return result, err
+}
+
+// GetTrash returns userId's deleted chirps that can still be restored, by ascending id
+func (db *DB) GetTrash(userId ID) ([]TrashedChirp, error) {
+	result := []TrashedChirp{}
+	err := db.View(func(tx *Tx) error {
+		for _, id := range tx.data.trashByAuthor[userId] {
+			chirp := tx.data.Chirps[id]
+			result = append(result, TrashedChirp{ChirpResponse: tx.renderChirp(chirp, userId), PurgeAt: chirp.DeletedAt.Add(db.trashRetention)})
+		}
+		return nil
+	})
+	return result, err
+}
+
+// purgeChirp removes a trashed chirp for good, along with its reactions, revisions and votes.
+//
+// Replies outlive what they answer: a chirp that still has replies is replaced
+// by a tombstone that keeps only its id, parent and timestamps, so threads
+// keep their shape and render it as a deleted placeholder. A chirp without
+// replies is removed outright, along with any purged tombstones above it that
+// no longer have a reply to hold up.
+func (tx *Tx) purgeChirp(chirp Chirp) error {
+	err := tx.dropReactions(chirp.Id)
+	if err != nil {
+		return err
+	}
+	err = tx.dropRevisions(chirp.Id)
+	if err != nil {
+		return err
+	}
+	err = tx.dropVotes(chirp.Id)
+	if err != nil {
+		return err
+	}
+
+	if len(tx.data.repliesTo[chirp.Id]) > 0 {
+		return tx.put(bucketChirps, chirp.Id.String(), tombstone(chirp))
+	}
+	for {
+		err := tx.del(bucketChirps, chirp.Id.String())
+		if err != nil {
+			return err
+		}
+		parent, ok := tx.data.Chirps[chirp.InReplyTo]
+		if !ok || !parent.Deleted || len(tx.data.repliesTo[parent.Id]) > 0 {
+			return nil
+		}
+		chirp = parent
+	}
+}
+
+func sweepTrash(tx *Tx, cutoff time.Time) (int, error) {
+	var stale []ID
+	for _, ids := range tx.data.trashByAuthor {
+		for _, id := range ids {
+			if tx.data.Chirps[id].DeletedAt.Before(cutoff) {
+				stale = append(stale, id)
+			}
+		}
+	}
+	for _, id := range stale {
+		err := tx.purgeChirp(tx.data.Chirps[id])
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(stale), nil
+}
+
+// { H{"Authorization: Bearer ${jwtToken}"} } -> ChirpResponse
+func (db *DB) HandlePostRestoreChirp(w http.ResponseWriter, r *http.Request) {
+	userId, err := db.authenticate(r)
+	if err != nil {
+		log.Print("RestoreChirp, authenticate:", err.Error())
+		w.WriteHeader(401)
+		return
+	}
+
+	chirpId, err := ParseID(r.PathValue("chirpId"))
+	if err != nil {
+		log.Print("RestoreChirp, ParseID:", err.Error())
+		w.WriteHeader(400)
+		return
+	}
+
+	chirp, err := db.RestoreChirp(chirpId, userId)
+	if errors.Is(err, ErrNotFound) {
+		w.WriteHeader(404)
+		return
+	}
+	if errors.Is(err, ErrGone) {
+		w.WriteHeader(410)
+		return
+	}
+	if errors.Is(err, errRestoreWindowClosed) {
+		db.sendJson(w, r, api.JsonErr{ErrorMsg: err.Error()}, 410)
+		return
+	}
+	if errors.Is(err, ErrForbidden) {
+		log.Print("Chirp author mismatch")
+		w.WriteHeader(403)
+		return
+	}
+	if err != nil {
+		log.Print("RestoreChirp:", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	err = db.sendJson(w, r, chirp, 200)
+	if err != nil {
+		log.Print("RestoreChirp, SendJson:", err.Error())
+	}
+}
+
+// { H{"Authorization: Bearer ${jwtToken}"} } -> []TrashedChirp
+func (db *DB) HandleGetTrash(w http.ResponseWriter, r *http.Request) {
+	userId, err := db.authenticate(r)
+	if err != nil {
+		log.Print("GetTrash, authenticate:", err.Error())
+		w.WriteHeader(401)
+		return
+	}
+
+	chirps, err := db.GetTrash(userId)
+	if err != nil {
+		log.Print("GetTrash:", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	err = db.sendJson(w, r, chirps, 200)
+	if err != nil {
+		log.Print("GetTrash, SendJson:", err.Error())
+	}
+}
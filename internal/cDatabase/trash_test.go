@@ -0,0 +1,58 @@
+package cDatabase
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestTrashHidesOpenPollTallies checks the trash renders chirps like every other listing,
+// an author who hasn't voted must not see the tallies of their open poll there
+func TestTrashHidesOpenPollTallies(t *testing.T) {
+	db := newTestDB(t, newMemStore())
+	var users []User
+	for _, email := range []string{"author@example.com", "voter@example.com"} {
+		user, err := db.createUser(email, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, user)
+	}
+	author, voter := users[0].Id, users[1].Id
+
+	poll, err := newPoll(pollRequest{Options: []string{"yes", "no"}, ClosesAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chirp, err := db.CreateChirp(NewChirp{Body: "question", AuthorId: author, Poll: poll})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CastVote(chirp.Id, voter, []int{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.DeleteChirp(chirp.Id, author)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trash, err := db.GetTrash(author)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 1 || trash[0].Id != chirp.Id {
+		t.Fatalf("trash = %v, want chirp %v", trash, chirp.Id)
+	}
+	dat, err := json.Marshal(trash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(dat), "tallies") {
+		t.Errorf("trash shows open poll tallies: %s", dat)
+	}
+	if !strings.Contains(string(dat), `"results_visible":false`) || !strings.Contains(string(dat), `"purge_at"`) {
+		t.Errorf("trash entry is not a rendered chirp: %s", dat)
+	}
+}
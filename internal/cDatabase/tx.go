@@ -0,0 +1,168 @@
+package cDatabase
+
+import (
+	"errors"
+	"internal/api"
+	"log"
+	"slices"
+)
+
+var (
+	ErrNotFound  = errors.New("not found")
+	ErrForbidden = errors.New("forbidden")
+	// ErrGone is returned for records that existed but were deleted
+	ErrGone     = errors.New("gone")
+	errReadOnly = errors.New("write in a read-only transaction")
+)
+
+// Tx is a consistent view of the dataset for the duration of Update or View.
+// Writes go through put and del so they reach the store when Update returns.
+type Tx struct {
+	data     *state
+	changes  []change
+	undo     []change
+	writable bool
+	idMode   string
+	filter   *api.ContentFilter
+	// blobs is only set for writable transactions
+	blobs BlobStore
+}
+
+// Update runs fn holding the write lock for the whole read-modify-write.
+// If fn returns nil its changes are committed to the store as one batch,
+// otherwise they are discarded.
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	tx := &Tx{data: db.data, writable: true, idMode: db.idMode, filter: db.filter, blobs: db.blobs}
+	defer db.deleteReleasedBlobs()
+
+	err := fn(tx)
+	if err != nil {
+		// changes are applied to the cache as the tx goes, undo them in reverse
+		undoErr := tx.rollbackTo(0)
+		if undoErr != nil {
+			log.Print("Update, rollback:", undoErr.Error())
+			db.reloadAfterFailure()
+		}
+		return err
+	}
+
+	if len(tx.changes) > 0 {
+		err = db.store.Commit(tx.changes)
+		if err != nil {
+			log.Print("Update, store.Commit:", err.Error())
+			// the store may hold some of the batch, trust what it reads back
+			db.reloadAfterFailure()
+		}
+	}
+	return err
+}
+
+// deleteReleasedBlobs deletes the blobs that lost their last reference during an Update
+// and didn't get one back before it ended, the caller must hold the write lock
+func (db *DB) deleteReleasedBlobs() {
+	for _, hash := range db.data.releasedBlobs {
+		if db.data.blobRefs[hash] > 0 {
+			continue
+		}
+		err := db.blobs.Delete(hash)
+		if err != nil {
+			log.Print("Update, blobs.Delete:", err.Error())
+		}
+	}
+	db.data.releasedBlobs = nil
+}
+
+// View runs fn under the read lock, any number of views can run at once.
+// Records read in fn must be copied out, not kept by reference.
+func (db *DB) View(fn func(tx *Tx) error) error {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	return fn(&Tx{data: db.data, idMode: db.idMode, filter: db.filter})
+}
+
+// reload replaces the cache with the dataset held by the store,
+// the caller must hold the write lock
+func (db *DB) reload() error {
+	data, err := db.store.Load()
+	if err != nil {
+		return err
+	}
+	db.data = newState(data)
+	return nil
+}
+
+// reloadAfterFailure reloads the cache when it can no longer be trusted,
+// the caller must hold the write lock
+func (db *DB) reloadAfterFailure() {
+	// blobs released by the failed batch are checked against what the store holds
+	released := db.data.releasedBlobs
+	err := db.reload()
+	if err != nil {
+		log.Print("Update, reload:", err.Error())
+		return
+	}
+	db.data.releasedBlobs = released
+}
+
+// idsOf copies the ids listed under key in index. put and del update index
+// slices in place, so a loop that writes must range over a copy of its ids.
+func idsOf[K comparable](index map[K][]ID, key K) []ID {
+	return slices.Clone(index[key])
+}
+
+// put stores v under key in bucket, later reads in the same tx see it
+func (tx *Tx) put(bucket, key string, v interface{}) error {
+	if !tx.writable {
+		return errReadOnly
+	}
+	c, err := putChange(bucket, key, v)
+	if err != nil {
+		return err
+	}
+	return tx.record(c)
+}
+
+// del removes key from bucket
+func (tx *Tx) del(bucket, key string) error {
+	if !tx.writable {
+		return errReadOnly
+	}
+	return tx.record(deleteChange(bucket, key))
+}
+
+func (tx *Tx) record(c change) error {
+	undo, err := tx.data.inverse(c)
+	if err != nil {
+		return err
+	}
+	err = tx.data.apply(c)
+	if err != nil {
+		return err
+	}
+	tx.changes = append(tx.changes, c)
+	tx.undo = append(tx.undo, undo)
+	return nil
+}
+
+// savepoint marks the changes made so far, rollbackTo(savepoint) undoes everything after it
+func (tx *Tx) savepoint() int {
+	return len(tx.changes)
+}
+
+// rollbackTo undoes every change made after the first n, newest first
+func (tx *Tx) rollbackTo(n int) error {
+	for len(tx.changes) > n {
+		last := len(tx.changes) - 1
+		err := tx.data.apply(tx.undo[last])
+		if err != nil {
+			return err
+		}
+		tx.changes = tx.changes[:last]
+		tx.undo = tx.undo[:last]
+	}
+	return nil
+}
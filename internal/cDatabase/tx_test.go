@@ -0,0 +1,212 @@
+package cDatabase
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func newTestDB(t *testing.T, store Store) *DB {
+	t.Helper()
+	db, err := NewDBWithStore(store, Config{MediaDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// TestConcurrentUpdates hammers Update from many goroutines while readers run View,
+// every write must survive with its own sequential id, in the cache and in the store.
+// Run it with go test -race so unsynchronised access fails the test as well.
+func TestConcurrentUpdates(t *testing.T) {
+	const writers = 20
+
+	store := newMemStore()
+	db := newTestDB(t, store)
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	var reads atomic.Int64
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			seen := 0
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				err := db.View(func(tx *Tx) error {
+					if len(tx.data.Chirps) < seen {
+						return fmt.Errorf("chirp count went from %d to %d", seen, len(tx.data.Chirps))
+					}
+					seen = len(tx.data.Chirps)
+					for id, chirp := range tx.data.Chirps {
+						if chirp.Id != id {
+							return fmt.Errorf("chirp %v stored under id %v", chirp.Id, id)
+						}
+					}
+					return nil
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				reads.Add(1)
+			}
+		}()
+	}
+
+	var writersDone sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		writersDone.Add(1)
+		go func() {
+			defer writersDone.Done()
+			user, err := db.createUser(fmt.Sprintf("user%d@example.com", i), "password")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_, err = db.CreateChirp(NewChirp{Body: fmt.Sprintf("chirp %d", i), AuthorId: user.Id})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	writersDone.Wait()
+	close(done)
+	readers.Wait()
+	if reads.Load() == 0 {
+		t.Error("no reads ran alongside the writers")
+	}
+
+	check := func(name string, db *DB) {
+		t.Helper()
+		db.View(func(tx *Tx) error {
+			if len(tx.data.Users) != writers {
+				t.Errorf("%s: %d users, want %d", name, len(tx.data.Users), writers)
+			}
+			if len(tx.data.Chirps) != writers {
+				t.Errorf("%s: %d chirps, want %d", name, len(tx.data.Chirps), writers)
+			}
+			bodies := make(map[string]bool)
+			for id := ID(1); id <= writers; id++ {
+				chirp, ok := tx.data.Chirps[id]
+				if !ok {
+					t.Errorf("%s: chirp id %v missing", name, id)
+					continue
+				}
+				if bodies[chirp.Body] {
+					t.Errorf("%s: chirp body %q stored twice", name, chirp.Body)
+				}
+				bodies[chirp.Body] = true
+				if _, ok := tx.data.Users[id]; !ok {
+					t.Errorf("%s: user id %v missing", name, id)
+				}
+				if _, ok := tx.data.Users[chirp.AuthorId]; !ok {
+					t.Errorf("%s: chirp %v has unknown author %v", name, id, chirp.AuthorId)
+				}
+			}
+			return nil
+		})
+	}
+	check("cache", db)
+	// a fresh DB on the same store sees exactly what was committed
+	check("store", newTestDB(t, store))
+}
+
+// loadCounter counts Loads so tests can tell a rollback from a reload
+type loadCounter struct {
+	Store
+	loads atomic.Int64
+}
+
+func (lc *loadCounter) Load() (DBStructure, error) {
+	lc.loads.Add(1)
+	return lc.Store.Load()
+}
+
+// TestRollbackUndoesChanges fails an Update halfway through a purge and a new chirp,
+// the cache must come back to what it was without reloading the store
+func TestRollbackUndoesChanges(t *testing.T) {
+	store := &loadCounter{Store: newMemStore()}
+	db := newTestDB(t, store)
+
+	for i := 1; i <= 2; i++ {
+		_, err := db.createUser(fmt.Sprintf("user%d@example.com", i), "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := db.SetFollow(2, 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chirp, err := db.CreateChirp(NewChirp{Body: "hello #rollback", AuthorId: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.React(bucketLikes, chirp.Id, 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := func() string {
+		var dat []byte
+		db.View(func(tx *Tx) error {
+			dat, err = json.Marshal(tx.data.DBStructure)
+			return err
+		})
+		return string(dat)
+	}
+	before := snapshot()
+	loads := store.loads.Load()
+
+	errBoom := errors.New("boom")
+	err = db.Update(func(tx *Tx) error {
+		err := tx.purgeChirp(tx.data.Chirps[chirp.Id])
+		if err != nil {
+			return err
+		}
+		_, err = tx.createChirp(NewChirp{Body: "gone #rollback", AuthorId: 2})
+		if err != nil {
+			return err
+		}
+		return errBoom
+	})
+	if !errors.Is(err, errBoom) {
+		t.Fatalf("Update returned %v, want errBoom", err)
+	}
+	if store.loads.Load() != loads {
+		t.Error("rollback reloaded the store")
+	}
+	if after := snapshot(); after != before {
+		t.Errorf("records after rollback:\n%s\nwant:\n%s", after, before)
+	}
+
+	// the indexes were rolled back along with the records
+	for name, q := range map[string]ChirpQuery{
+		"author":   {AuthorId: 1},
+		"tag":      {Tag: "rollback"},
+		"timeline": {TimelineOf: 2},
+	} {
+		page, err := db.GetChirps(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Chirps) != 1 || page.Chirps[0].Id != chirp.Id {
+			t.Errorf("%s: got %v, want only chirp %v", name, page.Chirps, chirp.Id)
+		}
+	}
+	db.View(func(tx *Tx) error {
+		if likers := tx.data.likesByChirp[chirp.Id]; len(likers) != 1 || likers[0] != 2 {
+			t.Errorf("likers after rollback = %v, want [2]", likers)
+		}
+		return nil
+	})
+}
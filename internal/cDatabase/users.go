@@ -8,7 +8,6 @@ import (
 	"internal/api"
 	"log"
 	"net/http"
-	"strconv"
 	"strings"
 	"time"
 
@@ -16,12 +15,16 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+var errEmailExists = errors.New("email already registered")
+
 type User struct {
-	Id           int    `json:"id"`
-	Email        string `json:"email"`
-	Password     string `json:"password"`
-	RefreshToken string `json:"refresh_token"`
-	IsChirpyRed  bool   `json:"is_chirpy_red"`
+	Id           ID        `json:"id"`
+	Email        string    `json:"email"`
+	Password     string    `json:"password"`
+	RefreshToken string    `json:"refresh_token"`
+	IsChirpyRed  bool      `json:"is_chirpy_red"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
 }
 
 type UserRequest struct {
@@ -30,9 +33,23 @@ type UserRequest struct {
 }
 
 type UserResponse struct {
-	Id          int    `json:"id"`
-	Email       string `json:"email"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
+	Id          ID        `json:"id"`
+	Email       string    `json:"email"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// PublicUser is what anyone may see of another user, the email stays private
+type PublicUser struct {
+	Id          ID        `json:"id"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// publicUser is the PublicUser view of user
+func publicUser(user User) PublicUser {
+	return PublicUser{Id: user.Id, IsChirpyRed: user.IsChirpyRed, CreatedAt: user.CreatedAt}
 }
 
 type UserLoginRequest struct {
@@ -42,11 +59,13 @@ type UserLoginRequest struct {
 }
 
 type UserLoginResponse struct {
-	Id           int    `json:"id"`
-	Email        string `json:"email"`
-	Token        string `json:"token"`
-	RefreshToken string `json:"refresh_token"`
-	IsChirpyRed  bool   `json:"is_chirpy_red"`
+	Id           ID        `json:"id"`
+	Email        string    `json:"email"`
+	Token        string    `json:"token"`
+	RefreshToken string    `json:"refresh_token"`
+	IsChirpyRed  bool      `json:"is_chirpy_red"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
 }
 
 type RefreshResponse struct {
@@ -57,16 +76,16 @@ type CustomClaim struct {
 	jwt.RegisteredClaims
 }
 
-func CreateRegisteredClaims(id, expireTime int) jwt.RegisteredClaims {
+func CreateRegisteredClaims(id ID, expireTime int) jwt.RegisteredClaims {
 	return jwt.RegisteredClaims{
 		Issuer:    "chirpy",
 		IssuedAt:  jwt.NewNumericDate(time.Now()),
 		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Duration(expireTime) * time.Second)),
-		Subject:   strconv.Itoa(id),
+		Subject:   id.String(),
 	}
 }
 
-func CreateJWTAuthToken(id, expireTime int) *jwt.Token {
+func CreateJWTAuthToken(id ID, expireTime int) *jwt.Token {
 	t := jwt.NewWithClaims(jwt.SigningMethodHS256,
 		CreateRegisteredClaims(id, expireTime),
 	)
@@ -75,63 +94,77 @@ func CreateJWTAuthToken(id, expireTime int) *jwt.Token {
 
 func (db *DB) createUser(email, password string) (User, error) {
 
-	dbStruct, err := db.loadDB()
-	if err != nil {
-		log.Print("createUser, loadDB")
-		return User{}, err
-	}
-
-	_, err = db.getUserByEmail(email)
-	if err == nil {
-		log.Print("createUser, getUserByEmail: email exists")
-		return User{}, err
-	}
-
+	// hash before taking the write lock, bcrypt is slow on purpose
 	pword, err := bcrypt.GenerateFromPassword([]byte(password), 10)
 	if err != nil {
 		log.Print("createUser, generatePasswordErr:", err.Error())
 		return User{}, err
 	}
-	c := 4
-	b := make([]byte, c)
-	r, err := rand.Read(b)
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
 	if err != nil {
 		log.Print("createUser, rand.Read error:", err.Error())
+		return User{}, err
 	}
+	rTokenString := hex.EncodeToString(b)
 
-	//Create user
-	id := len(dbStruct.Users) + 1
+	var newUser User
+	err = db.Update(func(tx *Tx) error {
+		if _, ok := tx.userByEmail(email); ok {
+			log.Print("createUser, getUserByEmail: email exists")
+			return errEmailExists
+		}
 
-	//Create Refresh Token
-	rTokenString := hex.EncodeToString([]byte(strconv.Itoa(r)))
-	expireAt := time.Now().Add(time.Duration(60*24) * time.Hour)
-	dbStruct.RTokens[rTokenString] = RToken{UserId: id, ExpireAt: expireAt}
+		//Create user
+		id, err := tx.nextID(bucketUsers)
+		if err != nil {
+			return err
+		}
 
-	newUser := User{Id: id, Email: email, Password: string(pword), RefreshToken: rTokenString, IsChirpyRed: false}
-	dbStruct.Users[id] = newUser
+		//Create Refresh Token
+		expireAt := time.Now().Add(time.Duration(60*24) * time.Hour)
+		err = tx.put(bucketRTokens, rTokenString, RToken{UserId: id, ExpireAt: expireAt})
+		if err != nil {
+			return err
+		}
 
-	//save
-	db.writeDB(dbStruct)
+		now := time.Now().UTC()
+		newUser = User{Id: id, Email: email, Password: string(pword), RefreshToken: rTokenString, IsChirpyRed: false, CreatedAt: now, UpdatedAt: now}
+		return tx.put(bucketUsers, id.String(), newUser)
+	})
+	if err != nil {
+		return User{}, err
+	}
 
 	return newUser, nil
 }
 
-func (db *DB) updateUser(id int, userRequest *UserRequest) (User, error) {
-	dbStruct, err := db.loadDB()
+func (db *DB) updateUser(id ID, userRequest *UserRequest) (User, error) {
+	pWord, err := bcrypt.GenerateFromPassword([]byte(userRequest.Password), 10)
 	if err != nil {
-		log.Print("updateUser, loadDB error:", err.Error())
+		log.Print("updateUser, generatePasswordErr:", err.Error())
 		return User{}, err
 	}
-	modUser := dbStruct.Users[id]
-	modUser.Email = userRequest.Email
-	pWord, err := bcrypt.GenerateFromPassword([]byte(userRequest.Password), 10)
+
+	var modUser User
+	err = db.Update(func(tx *Tx) error {
+		var ok bool
+		modUser, ok = tx.data.Users[id]
+		if !ok {
+			return ErrNotFound
+		}
+		if other, ok := tx.userByEmail(userRequest.Email); ok && other.Id != id {
+			return errEmailExists
+		}
+		modUser.Email = userRequest.Email
+		modUser.Password = string(pWord)
+		modUser.UpdatedAt = time.Now().UTC()
+		return tx.put(bucketUsers, id.String(), modUser)
+	})
 	if err != nil {
-		log.Print("updateUser, generatePasswordErr:", err.Error())
+		log.Print("updateUser, Update error:", err.Error())
 		return User{}, err
 	}
-	modUser.Password = string(pWord)
-	dbStruct.Users[id] = modUser
-	db.writeDB(dbStruct)
 
 	return modUser, nil
 }
@@ -157,9 +190,9 @@ func (db *DB) HandlePostUsers(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//trim pword
-	response := UserResponse{Id: user.Id, Email: user.Email}
+	response := UserResponse{Id: user.Id, Email: user.Email, CreatedAt: user.CreatedAt, UpdatedAt: user.UpdatedAt}
 
-	err = api.SendJson(w, r, response, 201)
+	err = db.sendJson(w, r, response, 201)
 	if err != nil {
 		log.Print("PostUsers, SendJson:", err.Error())
 		w.WriteHeader(503)
@@ -198,9 +231,9 @@ func (db *DB) HandleLoginRequest(w http.ResponseWriter, r *http.Request) {
 		log.Print("SIGN ERROR", err.Error())
 	}
 
-	userResp := UserLoginResponse{Id: user.Id, Email: user.Email, Token: s, RefreshToken: user.RefreshToken, IsChirpyRed: user.IsChirpyRed}
+	userResp := UserLoginResponse{Id: user.Id, Email: user.Email, Token: s, RefreshToken: user.RefreshToken, IsChirpyRed: user.IsChirpyRed, CreatedAt: user.CreatedAt, UpdatedAt: user.UpdatedAt}
 
-	err = api.SendJson(w, r, userResp, 200)
+	err = db.sendJson(w, r, userResp, 200)
 	if err != nil {
 		w.WriteHeader(500)
 		return
@@ -209,17 +242,25 @@ func (db *DB) HandleLoginRequest(w http.ResponseWriter, r *http.Request) {
 }
 
 func (db *DB) getUserByEmail(email string) (User, error) {
-	dbStruct, err := db.loadDB()
-	if err != nil {
-		return User{}, errors.New("failed to load db")
-	}
-
-	for _, item := range dbStruct.Users {
-		if item.Email == email {
-			return item, nil
+	var user User
+	err := db.View(func(tx *Tx) error {
+		var ok bool
+		user, ok = tx.userByEmail(email)
+		if !ok {
+			return errors.New("getUserByEmail, User not found")
 		}
+		return nil
+	})
+	return user, err
+}
+
+// userByEmail looks a user up by email inside a transaction
+func (tx *Tx) userByEmail(email string) (User, bool) {
+	id, ok := tx.data.usersByEmail[email]
+	if !ok {
+		return User{}, false
 	}
-	return User{}, errors.New("getUserByEmail, User not found")
+	return tx.data.Users[id], true
 }
 
 // { H{"Authorization: ${jwtToken}"}, {email, password} } -> {email, id}
@@ -255,7 +296,7 @@ func (db *DB) HandlePutUsersRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id, err := strconv.Atoi(claims.Subject)
+	id, err := ParseID(claims.Subject)
 	if err != nil {
 		log.Print("id string to int error", err.Error())
 		w.WriteHeader(401)
@@ -267,13 +308,14 @@ func (db *DB) HandlePutUsersRequest(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Print("Put Users, updateUser error:", err.Error())
 		w.WriteHeader(401)
+		return
 	}
 
 	//trim pword
-	response := UserResponse{Id: user.Id, Email: user.Email}
+	response := UserResponse{Id: user.Id, Email: user.Email, CreatedAt: user.CreatedAt, UpdatedAt: user.UpdatedAt}
 
 	//send response
-	err = api.SendJson(w, r, response, 200)
+	err = db.sendJson(w, r, response, 200)
 	if err != nil {
 		log.Print(err.Error())
 		w.WriteHeader(401)
@@ -308,16 +350,19 @@ func (db *DB) HandlePostRefresh(w http.ResponseWriter, r *http.Request) {
 		log.Print("PostRefresh SIGN ERROR", err.Error())
 	}
 
-	api.SendJson(w, r, RefreshResponse{Token: s}, 200)
+	db.sendJson(w, r, RefreshResponse{Token: s}, 200)
 }
 
-func (db *DB) ValidateRefreshToken(rToken string) (int, error) {
-	dbStruct, err := db.loadDB()
+func (db *DB) ValidateRefreshToken(rToken string) (ID, error) {
+	var result RToken
+	err := db.View(func(tx *Tx) error {
+		result = tx.data.RTokens[rToken]
+		return nil
+	})
 	if err != nil {
-		log.Print("CreateAccessToken loadDB:", err.Error())
+		log.Print("CreateAccessToken View:", err.Error())
 		return 0, err
 	}
-	result := dbStruct.RTokens[rToken]
 	if result.ExpireAt.Before(time.Now()) {
 		return 0, errors.New("referesh token expired")
 	}
@@ -333,31 +378,27 @@ func (db *DB) HandlePostRevoke(w http.ResponseWriter, r *http.Request) {
 	rToken := split[1]
 
 	//Remove token from DB
-	dbStruct, err := db.loadDB()
+	err := db.Update(func(tx *Tx) error {
+		return tx.del(bucketRTokens, rToken)
+	})
 	if err != nil {
-		log.Print("PostRevoke loadDB: ", err.Error())
-		w.WriteHeader(400)
+		log.Print("PostRevoke Update: ", err.Error())
+		w.WriteHeader(500)
 		return
 	}
-	delete(dbStruct.RTokens, rToken)
-	db.writeDB(dbStruct)
 
 	//return 204
 	w.WriteHeader(204)
 }
 
-func (db *DB) UpgradeUser(userId int) error {
-	dbStruct, err := db.loadDB()
-	if err != nil {
-		return errors.New("UpgradeUser loadDB failed")
-	}
-
-	user := dbStruct.Users[userId]
-	if user.Email == "" {
-		return errors.New("404")
-	}
-	user.IsChirpyRed = true
-	dbStruct.Users[userId] = user
-	db.writeDB(dbStruct)
-	return nil
+func (db *DB) UpgradeUser(userId ID) error {
+	return db.Update(func(tx *Tx) error {
+		user, ok := tx.data.Users[userId]
+		if !ok {
+			return ErrNotFound
+		}
+		user.IsChirpyRed = true
+		user.UpdatedAt = time.Now().UTC()
+		return tx.put(bucketUsers, userId.String(), user)
+	})
 }
@@ -0,0 +1,219 @@
+package cDatabase
+
+import (
+	"encoding"
+	"encoding/json"
+	"internal/api"
+	"net/http"
+	"reflect"
+	"sync"
+)
+
+// stringID is an ID on the wire of a snowflake DB, always a JSON string
+// so JavaScript clients never round it to a float
+type stringID ID
+
+func (id stringID) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + ID(id).String() + `"`), nil
+}
+
+// sendJson is api.SendJson with ids encoded for the DB's id mode:
+// numbers in sequence mode, strings in snowflake mode, old sequence ids included,
+// so a client sees one type per field whatever the value
+func (db *DB) sendJson(w http.ResponseWriter, r *http.Request, s interface{}, statusCode int) error {
+	if db.idMode == IDSnowflake {
+		s = withStringIDs(s)
+	}
+	return api.SendJson(w, r, s, statusCode)
+}
+
+var (
+	idType            = reflect.TypeOf(ID(0))
+	stringIDType      = reflect.TypeOf(stringID(0))
+	interfaceType     = reflect.TypeOf((*interface{})(nil)).Elem()
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// wireType is the type a value is copied into so every ID in it marshals as a stringID.
+// Structs are rebuilt with reflect.StructOf keeping names, tags and embedding,
+// so encoding/json applies its usual field rules to the copy.
+type wireType struct {
+	t reflect.Type
+	// convert is set if values need copying, they hold an ID or an interface that may
+	convert bool
+}
+
+// wireTypes caches the wireType of every type withStringIDs has seen
+var wireTypes sync.Map
+
+// withStringIDs returns a copy of v in which every ID marshals as a string
+func withStringIDs(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return v
+	}
+	wt := wireTypeOf(rv.Type(), map[reflect.Type]bool{})
+	if !wt.convert {
+		return v
+	}
+	return toWire(rv, wt.t).Interface()
+}
+
+// wireTypeOf works out the wire type of t. building lists the structs being rebuilt
+// further up, a recursive reference to one becomes interface{} and is converted
+// when the value is copied, so only results worked out from the top are cached.
+func wireTypeOf(t reflect.Type, building map[reflect.Type]bool) wireType {
+	if cached, ok := wireTypes.Load(t); ok {
+		return cached.(wireType)
+	}
+	top := len(building) == 0
+	wt := buildWireType(t, building)
+	if top {
+		wireTypes.Store(t, wt)
+	}
+	return wt
+}
+
+func buildWireType(t reflect.Type, building map[reflect.Type]bool) wireType {
+	if t == idType {
+		return wireType{t: stringIDType, convert: true}
+	}
+	// a type that marshals itself is sent as it is
+	if t.Implements(jsonMarshalerType) || reflect.PointerTo(t).Implements(jsonMarshalerType) ||
+		t.Implements(textMarshalerType) || reflect.PointerTo(t).Implements(textMarshalerType) {
+		return wireType{t: t}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		elem := wireTypeOf(t.Elem(), building)
+		if elem.t == interfaceType && t.Elem() != interfaceType {
+			// a pointer back to a struct being rebuilt
+			return elem
+		}
+		if elem.t != t.Elem() {
+			return wireType{t: reflect.PointerTo(elem.t), convert: true}
+		}
+		return wireType{t: t, convert: elem.convert}
+	case reflect.Slice:
+		elem := wireTypeOf(t.Elem(), building)
+		if elem.t != t.Elem() {
+			return wireType{t: reflect.SliceOf(elem.t), convert: true}
+		}
+		return wireType{t: t, convert: elem.convert}
+	case reflect.Array:
+		elem := wireTypeOf(t.Elem(), building)
+		if elem.t != t.Elem() {
+			return wireType{t: reflect.ArrayOf(t.Len(), elem.t), convert: true}
+		}
+		return wireType{t: t, convert: elem.convert}
+	case reflect.Map:
+		// integer keys, ID among them, are strings in JSON already
+		elem := wireTypeOf(t.Elem(), building)
+		if elem.t != t.Elem() {
+			return wireType{t: reflect.MapOf(t.Key(), elem.t), convert: true}
+		}
+		return wireType{t: t, convert: elem.convert}
+	case reflect.Interface:
+		// the dynamic value is converted when it is copied
+		return wireType{t: t, convert: true}
+	case reflect.Struct:
+		if building[t] {
+			return wireType{t: interfaceType, convert: true}
+		}
+		building[t] = true
+		defer delete(building, t)
+
+		var fields []reflect.StructField
+		convert := false
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			// encoding/json skips unexported fields, reflect.StructOf can't take them
+			if !field.IsExported() {
+				continue
+			}
+			ft := wireTypeOf(field.Type, building)
+			convert = convert || ft.convert
+			fields = append(fields, reflect.StructField{Name: field.Name, Type: ft.t, Tag: field.Tag, Anonymous: field.Anonymous})
+		}
+		if !convert {
+			return wireType{t: t}
+		}
+		return wireType{t: reflect.StructOf(fields), convert: true}
+	}
+	return wireType{t: t}
+}
+
+// toWire copies v into a value of dst, the wire type of v where it is held
+func toWire(v reflect.Value, dst reflect.Type) reflect.Value {
+	if dst == stringIDType {
+		return v.Convert(stringIDType)
+	}
+	if dst.Kind() == reflect.Interface {
+		result := reflect.New(dst).Elem()
+		if v.Kind() == reflect.Interface {
+			if v.IsNil() {
+				return result
+			}
+			v = v.Elem()
+		}
+		// a nil pointer stays a nil interface, so omitempty still drops it
+		if v.Kind() == reflect.Pointer && v.IsNil() {
+			return result
+		}
+		result.Set(toWire(v, wireTypeOf(v.Type(), map[reflect.Type]bool{}).t))
+		return result
+	}
+	if !wireTypeOf(v.Type(), map[reflect.Type]bool{}).convert {
+		return v
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return reflect.Zero(dst)
+		}
+		result := reflect.New(dst.Elem())
+		result.Elem().Set(toWire(v.Elem(), dst.Elem()))
+		return result
+	case reflect.Slice:
+		if v.IsNil() {
+			return reflect.Zero(dst)
+		}
+		result := reflect.MakeSlice(dst, v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			result.Index(i).Set(toWire(v.Index(i), dst.Elem()))
+		}
+		return result
+	case reflect.Array:
+		result := reflect.New(dst).Elem()
+		for i := 0; i < v.Len(); i++ {
+			result.Index(i).Set(toWire(v.Index(i), dst.Elem()))
+		}
+		return result
+	case reflect.Map:
+		if v.IsNil() {
+			return reflect.Zero(dst)
+		}
+		result := reflect.MakeMapWithSize(dst, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			result.SetMapIndex(iter.Key(), toWire(iter.Value(), dst.Elem()))
+		}
+		return result
+	case reflect.Struct:
+		// dst has the exported fields of v in the same order
+		result := reflect.New(dst).Elem()
+		j := 0
+		for i := 0; i < v.NumField(); i++ {
+			if !v.Type().Field(i).IsExported() {
+				continue
+			}
+			result.Field(j).Set(toWire(v.Field(i), dst.Field(j).Type))
+			j++
+		}
+		return result
+	}
+	return v
+}
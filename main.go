@@ -1,44 +1,218 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"internal/api"
 	"internal/cDatabase"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 func main() {
 
+	resetDB := flag.Bool("reset-db", false, "wipe the database on startup (dev only)")
+	migrateDryRun := flag.Bool("migrate-dry-run", false, "report pending schema migrations and exit without writing")
+	adminAddr := flag.String("addr", "http://localhost:8080", "server address for the backup, backups and restore commands")
+	flag.Parse()
+
 	err := godotenv.Load("config.env")
 	if err != nil {
 		log.Print("godotenv error: ", err.Error())
 	}
 	jwtSecret := os.Getenv("JWT_SECRET")
 	polkaApi := os.Getenv("polka_api")
-	dbPath := "database.json"
-	db, err := cDatabase.NewDB(dbPath, jwtSecret, polkaApi)
+	adminKey := os.Getenv("ADMIN_API_KEY")
+
+	if flag.NArg() > 0 {
+		err = runAdminCommand(flag.Args(), *adminAddr, adminKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// DB_BACKEND picks json (default), sqlite or memory, DB_PATH overrides the file name.
+	// All of them keep the full dataset in memory, sqlite only changes how it is persisted.
+	// ID_MODE picks sequence (default) or snowflake ids,
+	// BACKUP_DIR and BACKUP_RETAIN control where backups go and how many are kept,
+	// DB_ENCRYPTION_KEY encrypts the json backend and backups, DB_ENCRYPTION_KEY_PREVIOUS
+	// lists comma separated old keys still accepted while rotating,
+	// SWEEP_INTERVAL and WEBHOOK_RETENTION (Go durations) tune the background sweeper,
+	// CONTENT_FILTER names a JSON file of filter rules, reloaded on SIGHUP
+	dbBackend := os.Getenv("DB_BACKEND")
+	dbPath := os.Getenv("DB_PATH")
+	if dbPath == "" {
+		dbPath = "database.json"
+		if dbBackend == cDatabase.BackendSQLite {
+			dbPath = "chirpy.db"
+		}
+	}
+
+	backupRetain := 0
+	if s := os.Getenv("BACKUP_RETAIN"); s != "" {
+		backupRetain, err = strconv.Atoi(s)
+		if err != nil {
+			log.Fatal("BACKUP_RETAIN: ", err)
+		}
+	}
+
+	var previousKeys []string
+	if s := os.Getenv("DB_ENCRYPTION_KEY_PREVIOUS"); s != "" {
+		previousKeys = strings.Split(s, ",")
+	}
+
+	var contentFilter *api.ContentFilter
+	filterPath := os.Getenv("CONTENT_FILTER")
+	if filterPath != "" {
+		contentFilter, err = api.LoadContentFilter(filterPath)
+		if err != nil {
+			log.Fatal("CONTENT_FILTER: ", err)
+		}
+	}
+
+	dbConfig := cDatabase.Config{
+		Backend:                dbBackend,
+		Path:                   dbPath,
+		Reset:                  *resetDB,
+		IDMode:                 os.Getenv("ID_MODE"),
+		EncryptionKey:          os.Getenv("DB_ENCRYPTION_KEY"),
+		PreviousEncryptionKeys: previousKeys,
+		BackupDir:              os.Getenv("BACKUP_DIR"),
+		BackupRetain:           backupRetain,
+		AdminKey:               adminKey,
+		MediaDir:               os.Getenv("MEDIA_DIR"),
+		ContentFilter:          contentFilter,
+		SweepInterval:          durationEnv("SWEEP_INTERVAL"),
+		WebhookRetention:       durationEnv("WEBHOOK_RETENTION"),
+		ScheduleInterval:       durationEnv("SCHEDULE_INTERVAL"),
+		EditWindow:             durationEnv("EDIT_WINDOW"),
+		EditWindowRed:          durationEnv("EDIT_WINDOW_RED"),
+		TrashRetention:         durationEnv("TRASH_RETENTION"),
+		Secret:                 jwtSecret,
+		PolkaApi:               polkaApi,
+	}
+
+	if *migrateDryRun {
+		reports, err := cDatabase.PlanMigrations(dbConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(reports) == 0 {
+			fmt.Printf("%s is up to date\n", dbPath)
+		}
+		for _, report := range reports {
+			fmt.Printf("v%d -> v%d: %s\n", report.From, report.To, report.Description)
+			for _, line := range report.Changes {
+				fmt.Printf("\t%s\n", line)
+			}
+		}
+		return
+	}
+
+	db, err := cDatabase.NewDB(dbConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	defer db.Close()
+
+	// stop on ctrl-c or SIGTERM, background workers share the same context
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var workers sync.WaitGroup
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		db.RunSweeper(ctx)
+	}()
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		db.RunScheduler(ctx)
+	}()
+	if contentFilter != nil {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			reloadOnHangup(ctx, contentFilter)
+		}()
+	}
+
 	cfg := &api.ApiConfig{}
 
 	mux := http.NewServeMux()
 
-	mux.Handle("/app/*", cfg.MiddlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir(".")))))
+	// only the static directory is public, the working directory also holds
+	// the database, its journal, backups and uploaded media
+	mux.Handle("/app/", cfg.MiddlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir("static")))))
 
 	mux.HandleFunc("GET /api/healthz", api.ReadyEndP)
 
+	mux.HandleFunc("GET /media/{hash}", db.HandleGetMedia)
+
 	mux.HandleFunc("GET /admin/metrics", cfg.ServeAdminpage)
+	mux.HandleFunc("POST /admin/backups", db.HandlePostBackup)
+	mux.HandleFunc("GET /admin/backups", db.HandleGetBackups)
+	mux.HandleFunc("POST /admin/backups/{name}/restore", db.HandlePostRestore)
+	mux.HandleFunc("GET /admin/sweeper", db.HandleGetSweeper)
 	mux.HandleFunc("/api/reset", cfg.ResetHits)
 
 	mux.HandleFunc("GET /api/chirps", db.HandleGetChirpsRequest)
+	mux.HandleFunc("GET /api/chirps/search", db.HandleSearchChirps)
+	mux.HandleFunc("GET /api/chirps/trash", db.HandleGetTrash)
 	mux.HandleFunc("GET /api/chirps/{chirpId}", db.HandleGetChirpRequest)
+	mux.HandleFunc("GET /api/chirps/{chirpId}/thread", db.HandleGetThread)
 	mux.HandleFunc("POST /api/chirps", db.HandlePostChirpsRequest)
+	mux.HandleFunc("PUT /api/chirps/{chirpId}", db.HandlePutChirpsRequest)
 	mux.HandleFunc("DELETE /api/chirps/{chirpId}", db.HandleDeleteChirpsRequest)
+	mux.HandleFunc("POST /api/chirps/{chirpId}/restore", db.HandlePostRestoreChirp)
+	mux.HandleFunc("GET /api/chirps/{chirpId}/revisions", db.HandleGetRevisions)
+	mux.HandleFunc("POST /api/chirps/{chirpId}/like", db.HandlePostLike)
+	mux.HandleFunc("DELETE /api/chirps/{chirpId}/like", db.HandleDeleteLike)
+	mux.HandleFunc("POST /api/chirps/{chirpId}/rechirp", db.HandlePostRechirp)
+	mux.HandleFunc("DELETE /api/chirps/{chirpId}/rechirp", db.HandleDeleteRechirp)
+	mux.HandleFunc("POST /api/chirps/{chirpId}/vote", db.HandlePostVote)
+	mux.HandleFunc("GET /api/chirps/{chirpId}/poll", db.HandleGetPoll)
+	mux.HandleFunc("GET /api/chirps/{chirpId}/quotes", db.HandleGetQuotes)
+
+	mux.HandleFunc("GET /api/tags/{tag}/chirps", db.HandleGetTagChirps)
+	mux.HandleFunc("GET /api/users/{id}/mentions", db.HandleGetUserMentions)
+	mux.HandleFunc("GET /api/users/{id}/likes", db.HandleGetUserLikes)
+	mux.HandleFunc("POST /api/users/{id}/follow", db.HandlePostFollow)
+	mux.HandleFunc("DELETE /api/users/{id}/follow", db.HandleDeleteFollow)
+	mux.HandleFunc("GET /api/users/{id}/followers", db.HandleGetFollowers)
+	mux.HandleFunc("GET /api/users/{id}/following", db.HandleGetFollowing)
+	mux.HandleFunc("GET /api/timeline", db.HandleGetTimeline)
+
+	mux.HandleFunc("POST /api/drafts", db.HandlePostDraft)
+	mux.HandleFunc("GET /api/drafts", db.HandleGetDrafts)
+	mux.HandleFunc("GET /api/drafts/{draftId}", db.HandleGetDraft)
+	mux.HandleFunc("PUT /api/drafts/{draftId}", db.HandlePutDraft)
+	mux.HandleFunc("DELETE /api/drafts/{draftId}", db.HandleDeleteDraft)
+	mux.HandleFunc("POST /api/drafts/{draftId}/publish", db.HandlePostPublishDraft)
+
+	mux.HandleFunc("GET /api/bookmarks", db.HandleGetBookmarks)
+	mux.HandleFunc("PUT /api/bookmarks/{chirpId}", db.HandlePutBookmark)
+	mux.HandleFunc("DELETE /api/bookmarks/{chirpId}", db.HandleDeleteBookmark)
+	mux.HandleFunc("GET /api/collections", db.HandleGetCollections)
+	mux.HandleFunc("POST /api/collections", db.HandlePostCollection)
+	mux.HandleFunc("DELETE /api/collections/{collectionId}", db.HandleDeleteCollection)
+	mux.HandleFunc("GET /api/collections/{collectionId}/chirps", db.HandleGetBookmarks)
+	mux.HandleFunc("PUT /api/collections/{collectionId}/chirps/{chirpId}", db.HandlePutBookmark)
+	mux.HandleFunc("DELETE /api/collections/{collectionId}/chirps/{chirpId}", db.HandleDeleteBookmark)
 
 	mux.HandleFunc("POST /api/users", db.HandlePostUsers)
 	mux.HandleFunc("PUT /api/users", db.HandlePutUsersRequest)
@@ -56,6 +230,57 @@ func main() {
 		Handler: mux,
 	}
 
-	ser.ListenAndServe()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err := ser.Shutdown(shutdownCtx)
+		if err != nil {
+			log.Print("server shutdown: ", err.Error())
+		}
+	}()
+
+	err = ser.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Print("ListenAndServe: ", err.Error())
+	}
 
+	stop()
+	workers.Wait()
+	log.Print("shut down cleanly")
+}
+
+// durationEnv parses a Go duration such as "15m" from the environment, zero if unset
+func durationEnv(name string) time.Duration {
+	s := os.Getenv(name)
+	if s == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		log.Fatalf("%s: %s", name, err.Error())
+	}
+	return d
+}
+
+// reloadOnHangup re-reads the content filter file on every SIGHUP until ctx is done,
+// a file that fails to load is logged and the previous rules stay in force
+func reloadOnHangup(ctx context.Context, filter *api.ContentFilter) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			err := filter.Reload()
+			if err != nil {
+				log.Print("content filter reload: ", err.Error())
+				continue
+			}
+			log.Print("content filter reloaded")
+		}
+	}
 }